@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AdminAPIKeysScope is required to create, list or revoke API keys.
+const AdminAPIKeysScope = "admin:apikeys"
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey is a long-lived credential for machine clients. Only the SHA-256 of
+// the key is stored; the plain key is returned once, when it is created.
+type APIKey struct {
+	ID int64
+	// Tenant is the tenant the key acts for, inherited from the admin that
+	// created it
+	Tenant    string `json:"-" xml:"-"`
+	Owner     string
+	Prefix    string
+	Scopes    []string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return "rig_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// CreateAPIKey stores a new key for key.Owner and returns its plain value.
+func (key *APIKey) CreateAPIKey(ctx context.Context, db *sql.DB) (string, error) {
+	plain, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+	key.Prefix = plain[:12]
+
+	err = queryRowTraced(ctx, db,
+		`INSERT INTO apikey(Tenant, Owner, Prefix, KeyHash, Scopes)
+		 VALUES($1, $2, $3, $4, $5)
+		 RETURNING Id, CreatedAt`,
+		key.Tenant,
+		key.Owner,
+		key.Prefix,
+		hashAPIKey(plain),
+		pq.Array(key.Scopes),
+	).Scan(&key.ID, &key.CreatedAt)
+
+	if err != nil {
+		return "", err
+	}
+
+	return plain, nil
+}
+
+func GetAPIKeys(ctx context.Context, db *sql.DB, tenant string) ([]APIKey, error) {
+	rows, err := queryTraced(ctx, db, `SELECT Id, Tenant, Owner, Prefix, Scopes, CreatedAt, RevokedAt FROM apikey WHERE Tenant = $1 ORDER BY Id`, tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(&key.ID, &key.Tenant, &key.Owner, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &key.RevokedAt)
+
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// FindAPIKey looks up an active key by its plain value.
+func FindAPIKey(ctx context.Context, db *sql.DB, plain string) (*APIKey, error) {
+	var key APIKey
+
+	err := queryRowTraced(ctx, db,
+		`SELECT Id, Tenant, Owner, Prefix, Scopes, CreatedAt, RevokedAt
+		 FROM apikey
+		 WHERE KeyHash = $1 AND RevokedAt IS NULL`,
+		hashAPIKey(plain),
+	).Scan(&key.ID, &key.Tenant, &key.Owner, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &key.RevokedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// RevokeAPIKey marks a key as revoked. It reports false when the tenant has
+// no active key with that id.
+func RevokeAPIKey(ctx context.Context, db *sql.DB, tenant string, id int64) (bool, error) {
+	result, err := execTraced(ctx, db, `UPDATE apikey SET RevokedAt = now() WHERE Id = $1 AND Tenant = $2 AND RevokedAt IS NULL`, id, tenant)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// APIKeyAuthenticator accepts keys sent as "Authorization: ApiKey <key>" or
+// in the X-API-Key header.
+type APIKeyAuthenticator struct {
+	DB *sql.DB
+}
+
+func (auth *APIKeyAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+	plain := request.Header.Get("X-API-Key")
+
+	if header := request.Header.Get("Authorization"); plain == "" && len(header) > 7 && strings.EqualFold(header[:7], "apikey ") {
+		plain = strings.TrimSpace(header[7:])
+	}
+
+	if plain == "" {
+		return nil, ErrTokenNotFound
+	}
+
+	key, err := FindAPIKey(request.Context(), auth.DB, plain)
+	if err == ErrInvalidAPIKey {
+		return nil, err
+	}
+	if err != nil {
+		// Not the caller's fault: the key can't be checked right now
+		return nil, &StoreError{Kind: ErrUnavailable, Err: err}
+	}
+
+	return &Principal{
+		Subject: key.Owner,
+		Tenant:  key.Tenant,
+		Scopes:  key.Scopes,
+		Method:  "api_key",
+		KeyID:   key.ID,
+	}, nil
+}
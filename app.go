@@ -1,40 +1,177 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type App struct {
-	Router *mux.Router
+	Router  *mux.Router
+	Auth    *Authenticator
+	Limiter *RateLimiter
+	PDF     *PDFTemplate
+	Config  Config
+	Logger  *slog.Logger
+
+	shutdownTracing func(context.Context) error
 }
 
-func (app *App) Initialize(user, password, dbname string) {
-	err := ConnectDatabase(user, password, dbname)
+func (app *App) Initialize(config Config) error {
+	app.Config = config
+
+	var err error
+	app.Logger, err = NewLogger(config.Logging, os.Stdout)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(app.Logger)
+
+	err = ConnectDatabase(config.Database)
+	if err != nil {
+		return err
+	}
+
+	// sql.Open doesn't connect; fail now rather than on the first request
+	ctx, cancel := context.WithTimeout(context.Background(), config.Database.ConnectTimeout)
+	defer cancel()
+
+	if err := dbConnection.PingContext(ctx); err != nil {
+		dbConnection.Close()
+		return fmt.Errorf("database unreachable: %v", err)
+	}
+
+	if err := registerDBStats(dbConnection); err != nil {
+		return err
+	}
+
+	app.Auth, err = NewAuthenticator(config.Auth)
+	if err != nil {
+		return err
+	}
+
+	app.PDF, err = NewPDFTemplate(config.PDF)
+	if err != nil {
+		return err
+	}
 
+	app.Limiter = NewRateLimiter(NewMemoryRateLimitStore(), config.RateLimits.Limits())
+
+	app.shutdownTracing, err = setupTracing(config.Tracing)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	app.Router = mux.NewRouter()
+	app.Router.Use(recordRoute, TracingMiddleware, MetricsMiddleware)
 	app.initializeRoutes()
+
+	return nil
 }
 
 func (app *App) initializeRoutes() {
-	app.Router.Handle("/invoice", CreateInvoiceHandler).Methods("POST")
-	app.Router.Handle("/invoices", GetInvoicesHandler).Methods("GET")
-	app.Router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}", GetInvoicesHandler).Methods("GET")
-	app.Router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}", GetInvoicesHandler).Methods("GET")
-	app.Router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}", GetInvoicesHandler).Methods("GET")
-	app.Router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}", UpdateInvoiceHandler).Methods("PUT")
-	app.Router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}", DeleteInvoiceHandler).Methods("DELETE")
+	app.Router.Handle("/healthz", Negotiate()(LivenessHandler)).Methods("GET")
+	app.Router.Handle("/readyz", Negotiate()(http.HandlerFunc(app.ReadinessHandler))).Methods("GET")
+	app.Router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	app.Router.Handle("/openapi.json", OpenAPIHandler).Methods("GET")
+
+	app.apiRoutes(app.Router.PathPrefix("/v1").Subrouter(), APIVersion(1))
+	app.apiRoutes(app.Router, func(next http.Handler) http.Handler { return Deprecated(APIVersion(0)(next)) })
+
+	if app.Config.Auth.DevTokenIssuer {
+		app.Logger.Warn("development token issuer enabled", "path", "/oauth/token")
+		body := RequestBody(app.Config.Server.MaxBodyBytes, app.Config.Server.StrictJSON)
+		app.Router.Handle("/oauth/token", Negotiate()(body(DevTokenHandler(app.Auth)))).Methods("POST")
+	}
+}
+
+// apiRoutes registers the API on router, every route going through version
+// first.
+func (app *App) apiRoutes(router *mux.Router, version func(http.Handler) http.Handler) {
+	authenticated := AuthMiddleware(app.Auth, &APIKeyAuthenticator{DB: dbConnection})
+	guard := func(negotiation func(http.Handler) http.Handler, class string, timeout time.Duration, handler http.Handler) http.Handler {
+		return version(negotiation(authenticated(app.Limiter.Middleware(class)(QueryTimeout(timeout)(handler)))))
+	}
+	// formats are the media types handler produces besides the codecs'
+	protect := func(class string, timeout time.Duration, handler http.Handler, formats ...string) http.Handler {
+		return guard(Negotiate(formats...), class, timeout, handler)
+	}
+	admin := func(timeout time.Duration, handler http.Handler) http.Handler {
+		return protect(RouteClassAdmin, timeout, RequireScope(AdminAPIKeysScope)(handler))
+	}
+	timeouts := app.Config.Database.Timeouts
+	body := RequestBody(app.Config.Server.MaxBodyBytes, app.Config.Server.StrictJSON)
+
+	router.Handle("/invoice", protect(RouteClassWrite, timeouts.Create, body(CreateInvoiceHandler))).Methods("POST")
+	router.Handle("/invoices", protect(RouteClassRead, timeouts.Get, GetInvoicesHandler)).Methods("GET")
+	router.Handle("/invoices/batch", protect(RouteClassWrite, timeouts.Batch, body(BatchInvoicesHandler))).Methods("POST")
+	router.Handle("/invoices/import", protect(RouteClassWrite, timeouts.Import, BodyLimit(app.Config.Server.MaxImportBytes, app.Config.Server.StrictJSON)(ImportInvoicesHandler))).Methods("POST")
+	router.Handle("/invoices/summary", protect(RouteClassRead, timeouts.Get, SummarizeInvoicesHandler)).Methods("GET")
+	router.Handle("/invoices/timeseries", protect(RouteClassRead, timeouts.Get, TimeseriesHandler)).Methods("GET")
+	router.Handle("/documents/{document:[a-zA-Z0-9]{14}}/statement", protect(RouteClassRead, timeouts.Get, StatementHandler, "text/csv")).Methods("GET")
+	router.Handle("/invoices/export", guard(NegotiateFormats(exportFormats...), RouteClassRead, timeouts.Export, ExportInvoicesHandler)).Methods("GET")
+	router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}", protect(RouteClassRead, timeouts.Get, GetInvoicesHandler)).Methods("GET")
+	router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}", protect(RouteClassRead, timeouts.Get, GetInvoicesHandler)).Methods("GET")
+	router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}", protect(RouteClassRead, timeouts.Get, InvoicePDF(app.PDF)(GetInvoicesHandler), "application/pdf")).Methods("GET")
+	router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}", protect(RouteClassWrite, timeouts.Update, body(UpdateInvoiceHandler))).Methods("PUT")
+	router.Handle("/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}", protect(RouteClassWrite, timeouts.Delete, DeleteInvoiceHandler)).Methods("DELETE")
+
+	router.Handle("/apikeys", admin(timeouts.Create, body(CreateAPIKeyHandler))).Methods("POST")
+	router.Handle("/apikeys", admin(timeouts.Get, GetAPIKeysHandler)).Methods("GET")
+	router.Handle("/apikeys/{id:[0-9]+}", admin(timeouts.Delete, RevokeAPIKeyHandler)).Methods("DELETE")
 }
 
-func (app *App) Run(port string) {
-	log.Fatal(http.ListenAndServe(port, handlers.LoggingHandler(os.Stdout, app.Router)))
+// Run serves until SIGINT or SIGTERM, then stops accepting connections,
+// waits up to the shutdown timeout for in-flight requests and closes the
+// database pool.
+func (app *App) Run() error {
+	config := app.Config.Server
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           RequestLogMiddleware(app.Logger)(app.Router),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	app.Logger.Info("listening", "address", config.Listen)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		dbConnection.Close()
+		app.shutdownTracing(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	app.Logger.Info("shutting down, draining connections")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if closeErr := dbConnection.Close(); err == nil {
+		err = closeErr
+	}
+	if tracingErr := app.shutdownTracing(shutdownCtx); err == nil {
+		err = tracingErr
+	}
+
+	return err
 }
@@ -1,29 +1,289 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
-	"github.com/auth0-community/auth0"
 	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
-		secret := []byte(os.Getenv("API_SECRET"))
-		secretProvider := auth0.NewKeyProvider(secret)
-		audience := []string{os.Getenv("API_AUDIENCE")}
+// DefaultClockSkew is the tolerance applied to the exp, nbf and iat claims
+// unless configured otherwise.
+const DefaultClockSkew = time.Minute
 
-		configuration := auth0.NewConfiguration(secretProvider, audience, os.Getenv("API_ISSUER"), jose.HS256)
-		validator := auth0.NewValidator(configuration)
+// invalidCredentials is all a rejected caller is told; why its credentials
+// were refused is only logged, so it can't be used to probe the validator.
+const invalidCredentials = "Invalid or missing credentials"
 
-		if token, err := validator.ValidateRequest(request); err != nil {
-			RespondWithError(response, http.StatusUnauthorized, err.Error())
-			fmt.Println(err)
-			fmt.Println("Token is not valid:", token)
-		} else {
-			next.ServeHTTP(response, request)
+// DefaultTenantClaim is the token claim naming the caller's tenant unless
+// configured otherwise.
+const DefaultTenantClaim = "org_id"
+
+var (
+	ErrTokenNotFound    = errors.New("token not found")
+	ErrInvalidAlgorithm = errors.New("token signed with an unexpected algorithm")
+	ErrMissingScope     = errors.New("insufficient scope")
+	ErrMissingTenant    = errors.New("token names no tenant")
+)
+
+type AuthConfig struct {
+	Secret    string        `yaml:"secret"`
+	Audience  string        `yaml:"audience"`
+	Issuer    string        `yaml:"issuer"`
+	ClockSkew time.Duration `yaml:"clock_skew"`
+	// TenantClaim names the claim holding the tenant; tokens without it are
+	// their own tenant, keyed by subject
+	TenantClaim string `yaml:"tenant_claim"`
+	// DevTokenIssuer exposes POST /oauth/token, which signs tokens for anyone
+	DevTokenIssuer bool `yaml:"dev_token_issuer"`
+}
+
+// Claims are the validated claims of a request token. They are placed in the
+// request context by AuthMiddleware and can be read back with ClaimsFromContext.
+type Claims struct {
+	jwt.Claims
+	Scope  string `json:"scope,omitempty"`
+	Tenant string `json:"-"`
+}
+
+// Principal is the authenticated caller of a request, whatever credential it
+// presented. Claims is only set for callers authenticated with a JWT, KeyID
+// only for those using an API key.
+type Principal struct {
+	Subject string
+	Tenant  string
+	Scopes  []string
+	Method  string
+	Claims  *Claims
+	KeyID   int64
+}
+
+// RequestAuthenticator checks one kind of credential. Implementations return
+// ErrTokenNotFound when the request carries no credential they understand, so
+// AuthMiddleware can move on to the next one.
+type RequestAuthenticator interface {
+	Authenticate(request *http.Request) (*Principal, error)
+}
+
+// Authenticator validates HS256 bearer tokens against a fixed key, audience
+// and issuer. It is built once at startup and shared by every request.
+type Authenticator struct {
+	secret      []byte
+	audience    jwt.Audience
+	issuer      string
+	clockSkew   time.Duration
+	tenantClaim string
+}
+
+type contextKey int
+
+const (
+	principalContextKey contextKey = iota
+	requestInfoContextKey
+	strictJSONContextKey
+	apiVersionContextKey
+)
+
+func (config AuthConfig) Validate() error {
+	if config.Secret == "" {
+		return errors.New("auth: API secret must not be empty")
+	}
+	if config.Issuer == "" {
+		return errors.New("auth: API issuer must not be empty")
+	}
+	// Without it, tokens the issuer signs for any of its other clients would
+	// do for this API too
+	if config.Audience == "" {
+		return errors.New("auth: API audience must not be empty")
+	}
+	if config.ClockSkew < 0 {
+		return errors.New("auth: clock skew must not be negative")
+	}
+	if config.TenantClaim == "" {
+		return errors.New("auth: tenant claim must not be empty")
+	}
+
+	return nil
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Authenticator{
+		secret:      []byte(config.Secret),
+		audience:    jwt.Audience{config.Audience},
+		issuer:      config.Issuer,
+		clockSkew:   config.ClockSkew,
+		tenantClaim: config.TenantClaim,
+	}, nil
+}
+
+// ValidateRequest extracts the bearer token from the Authorization header and
+// returns its claims if the signature, audience, issuer and validity window
+// all check out.
+func (auth *Authenticator) ValidateRequest(request *http.Request) (*Claims, error) {
+	raw, err := bearerToken(request)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range token.Headers {
+		if header.Algorithm != string(jose.HS256) {
+			return nil, ErrInvalidAlgorithm
+		}
+	}
+
+	claims := &Claims{}
+	extra := map[string]interface{}{}
+	if err := token.Claims(auth.secret, claims, &extra); err != nil {
+		return nil, err
+	}
+
+	if tenant, ok := extra[auth.tenantClaim].(string); ok {
+		claims.Tenant = tenant
+	}
+
+	expected := jwt.Expected{
+		Issuer:   auth.issuer,
+		Audience: auth.audience,
+		Time:     time.Now(),
+	}
+
+	if err := claims.ValidateWithLeeway(expected, auth.clockSkew); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (auth *Authenticator) Authenticate(request *http.Request) (*Principal, error) {
+	claims, err := auth.ValidateRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant := claims.Tenant
+	if tenant == "" {
+		tenant = claims.Subject
+	}
+	// Every row belongs to a named tenant. Letting an empty one through would
+	// scope the caller to no tenant at all, which is never a valid owner
+	if tenant == "" {
+		return nil, ErrMissingTenant
+	}
+
+	return &Principal{
+		Subject: claims.Subject,
+		Tenant:  tenant,
+		Scopes:  strings.Fields(claims.Scope),
+		Method:  "jwt",
+		Claims:  claims,
+	}, nil
+}
+
+func bearerToken(request *http.Request) (string, error) {
+	header := request.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:]), nil
+	}
+
+	return "", ErrTokenNotFound
+}
+
+func (principal *Principal) HasScope(scope string) bool {
+	for _, s := range principal.Scopes {
+		if s == scope {
+			return true
 		}
-	})
+	}
+
+	return false
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey).(*Principal)
+	return principal, ok
+}
+
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.Claims == nil {
+		return nil, false
+	}
+
+	return principal.Claims, true
+}
+
+// AuthMiddleware tries each authenticator in turn and lets the request through
+// with the first principal found. A credential that is present but invalid
+// is rejected straight away instead of falling through to the next check.
+func AuthMiddleware(authenticators ...RequestAuthenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			ctx, span := tracer.Start(request.Context(), "AuthMiddleware")
+			principal, err := authenticate(request.WithContext(ctx), authenticators)
+			endSpan(span, err)
+
+			if errors.Is(err, ErrUnavailable) {
+				respondWithStoreError(response, request, "API key", err)
+				return
+			}
+
+			if err != nil {
+				authFailures.WithLabelValues(authFailureReason(err)).Inc()
+				LoggerFromContext(request.Context()).Warn("authentication failed", "reason", authFailureReason(err), "error", err)
+				RespondWithError(response, http.StatusUnauthorized, invalidCredentials)
+				return
+			}
+
+			if info := requestInfoFromContext(request.Context()); info != nil {
+				info.Subject = principal.Subject
+			}
+
+			ctx = context.WithValue(request.Context(), principalContextKey, principal)
+			next.ServeHTTP(response, request.WithContext(ctx))
+		})
+	}
+}
+
+func authenticate(request *http.Request, authenticators []RequestAuthenticator) (*Principal, error) {
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(request)
+
+		if err == ErrTokenNotFound {
+			continue
+		}
+
+		return principal, err
+	}
+
+	return nil, ErrTokenNotFound
+}
+
+// RequireScope rejects authenticated requests whose principal lacks scope. It
+// must run after AuthMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			principal, ok := PrincipalFromContext(request.Context())
+			if !ok || !principal.HasScope(scope) {
+				authFailures.WithLabelValues(authFailureReason(ErrMissingScope)).Inc()
+				RespondWithError(response, http.StatusForbidden, ErrMissingScope.Error())
+				return
+			}
+
+			next.ServeHTTP(response, request)
+		})
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestAuthenticateTenant(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthConfig{Secret: "secret", Issuer: "https://issuer/", Audience: "https://invoices/", TenantClaim: DefaultTenantClaim})
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+
+	sign := func(subject string, extra map[string]interface{}) string {
+		claims := jwt.Claims{Issuer: "https://issuer/", Audience: jwt.Audience{"https://invoices/"}, Subject: subject, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+		token, err := jwt.Signed(signer).Claims(claims).Claims(extra).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	for name, test := range map[string]struct {
+		token  string
+		tenant string
+		err    error
+	}{
+		"tenant claim":       {sign("batch@clients", map[string]interface{}{"org_id": "acme"}), "acme", nil},
+		"subject fallback":   {sign("batch@clients", nil), "batch@clients", nil},
+		"neither":            {sign("", nil), "", ErrMissingTenant},
+		"empty tenant claim": {sign("", map[string]interface{}{"org_id": ""}), "", ErrMissingTenant},
+	} {
+		request, _ := http.NewRequest("GET", "/invoices", nil)
+		request.Header.Set("Authorization", "Bearer "+test.token)
+
+		principal, err := auth.Authenticate(request)
+		if err != test.err {
+			t.Errorf("%s: expected error %v. Got %v\n", name, test.err, err)
+			continue
+		}
+		if err == nil && principal.Tenant != test.tenant {
+			t.Errorf("%s: expected tenant %q. Got %q\n", name, test.tenant, principal.Tenant)
+		}
+	}
+}
+
+func TestAuthMiddlewareMessage(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthConfig{Secret: "secret", Issuer: "https://issuer/", Audience: "https://invoices/", TenantClaim: DefaultTenantClaim})
+	expired, _ := auth.MintToken(TokenRequest{Subject: "batch@clients", TTL: -time.Hour})
+	handler := AuthMiddleware(auth)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusOK)
+	}))
+
+	for _, authorization := range []string{"", "Bearer not.a.token", "Bearer " + expired} {
+		request, _ := http.NewRequest("GET", "/invoices", nil)
+		request.Header.Set("Authorization", authorization)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+		var body map[string]string
+		json.Unmarshal(response.Body.Bytes(), &body)
+		if body["error"] != invalidCredentials || body["code"] != "unauthorized" {
+			t.Errorf("Expected the fixed message and code for %q. Got %s\n", authorization, response.Body.String())
+		}
+	}
+}
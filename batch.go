@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// maxBatchOperations bounds the size of a batch, and so how long it holds
+// its transaction open.
+const maxBatchOperations = 500
+
+var (
+	errRolledBack  = errors.New("rolled back")
+	errNotExecuted = errors.New("not executed")
+)
+
+var batchDocument = regexp.MustCompile(`^[a-zA-Z0-9]{14}$`)
+
+// BatchOperation is one create, update or delete of a batch. Updates and
+// deletes name their invoice by Year, Month and Document, as the routes do.
+type BatchOperation struct {
+	Op       string                 `json:"op"`
+	Year     int                    `json:"year,omitempty"`
+	Month    int                    `json:"month,omitempty"`
+	Document string                 `json:"document,omitempty"`
+	Invoice  *Invoice               `json:"invoice,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+type BatchRequest struct {
+	// Atomic makes the batch all-or-nothing
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// batchRequestV1 is BatchRequest with the invoices of creates and the
+// fields of updates in the form /v1 takes them.
+type batchRequestV1 struct {
+	Atomic     bool `json:"atomic"`
+	Operations []struct {
+		BatchOperation
+		Invoice *InvoiceInputV1 `json:"invoice,omitempty"`
+	} `json:"operations"`
+}
+
+// BatchResult is what the individual endpoint would have answered to the
+// operation at the same index.
+type BatchResult struct {
+	Status int    `json:"status"`
+	Result string `json:"result,omitempty"`
+	// Invoice is an Invoice or, on /v1, an InvoiceV1
+	Invoice interface{} `json:"invoice,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
+}
+
+// Validate checks an operation before it goes near the database.
+func (operation *BatchOperation) Validate() error {
+	switch operation.Op {
+	case "create":
+		if operation.Invoice == nil {
+			return &ValidationError{"create needs an invoice"}
+		}
+		return operation.Invoice.Validate()
+	case "update", "delete":
+		if operation.Year < 1950 || operation.Year > 2099 || operation.Month < 1 || operation.Month > 12 || !batchDocument.MatchString(operation.Document) {
+			return &ValidationError{"Invalid product year/month/document ID"}
+		}
+		if operation.Op == "update" {
+			return validateUpdate(operation.Fields)
+		}
+		return nil
+	default:
+		return &ValidationError{"op must be create, update or delete"}
+	}
+}
+
+func (operation *BatchOperation) execute(ctx context.Context, tx *sql.Tx, tenant string) error {
+	if err := operation.Validate(); err != nil {
+		return err
+	}
+
+	switch operation.Op {
+	case "create":
+		operation.Invoice.Tenant = tenant
+		return operation.Invoice.insert(ctx, tx)
+	case "update":
+		invoice := Invoice{Tenant: tenant}
+		return invoice.update(ctx, tx, operation.Month, operation.Year, operation.Document, operation.Fields)
+	default:
+		invoice := Invoice{Tenant: tenant, ReferenceMonth: operation.Month, ReferenceYear: operation.Year, Document: operation.Document}
+		return invoice.softDelete(ctx, tx)
+	}
+}
+
+// RunBatch executes operations for tenant in a single transaction and
+// returns the outcome of each, nil for success. Each operation runs in a
+// savepoint, so one failing doesn't take the others with it, unless atomic
+// is set: then the first failure rolls the batch back, and the operations
+// done before it report errRolledBack and those after errNotExecuted.
+func RunBatch(ctx context.Context, db *sql.DB, tenant string, atomic bool, operations []BatchOperation) (outcomes []error, err error) {
+	defer observeQuery("batch", time.Now())
+	ctx, span := tracer.Start(ctx, "RunBatch")
+	defer func() { endSpan(span, err) }()
+
+	outcomes = make([]error, len(operations))
+	failed := -1
+
+	err = withTenant(ctx, db, tenant, func(tx *sql.Tx) error {
+		for i := range operations {
+			operation := &operations[i]
+			outcomes[i] = inSavepoint(ctx, tx, func() error { return operation.execute(ctx, tx, tenant) })
+
+			if outcomes[i] == nil {
+				continue
+			}
+			// Only failures of the operation itself are reported per operation
+			if classified := classifyError(outcomes[i]); errors.Is(classified, ErrUnavailable) || errors.Is(classified, ErrTimeout) {
+				return outcomes[i]
+			}
+			if atomic {
+				failed = i
+				return outcomes[i]
+			}
+		}
+
+		return nil
+	})
+
+	if failed >= 0 {
+		for i := range outcomes {
+			if i < failed {
+				outcomes[i] = errRolledBack
+			} else if i > failed {
+				outcomes[i] = errNotExecuted
+			}
+		}
+		return outcomes, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return outcomes, nil
+}
+
+// BatchInvoicesHandler runs many creates, updates and deletes in one
+// request and one transaction. It answers 200 with a result per operation,
+// unless an atomic batch failed, which gets a 422 and a 424 for each of the
+// operations undone or skipped because of the failure.
+var BatchInvoicesHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "BatchInvoicesHandler")
+	defer span.End()
+
+	// XML has no way to spell the free-form fields of updates
+	if _, isXML := requestCodec(request).(xmlCodec); isXML {
+		RespondWithError(response, http.StatusUnsupportedMediaType, "Content-Type must be application/json or application/msgpack")
+		return
+	}
+
+	var batch BatchRequest
+	if err := decodeBatch(request, &batch); err != nil {
+		respondWithBodyError(response, err)
+		return
+	}
+
+	if len(batch.Operations) == 0 || len(batch.Operations) > maxBatchOperations {
+		RespondWithError(response, http.StatusBadRequest, fmt.Sprintf("A batch takes 1 to %d operations", maxBatchOperations))
+		return
+	}
+
+	outcomes, err := RunBatch(ctx, dbConnection, tenantFromRequest(request), batch.Atomic, batch.Operations)
+	if err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
+	}
+
+	status := http.StatusOK
+	results := make([]BatchResult, len(outcomes))
+
+	for i, outcome := range outcomes {
+		operation := batch.Operations[i]
+
+		if batch.Atomic && outcome != nil {
+			status = http.StatusUnprocessableEntity
+		}
+
+		switch {
+		case outcome == errRolledBack || outcome == errNotExecuted:
+			results[i] = BatchResult{Status: http.StatusFailedDependency, Error: outcome.Error(), Code: errorCodes[http.StatusFailedDependency]}
+		case outcome != nil:
+			code, message := storeErrorResponse(ctx, "Invoice", outcome)
+			results[i] = BatchResult{Status: code, Error: message, Code: errorCodes[code]}
+		case operation.Op == "create":
+			results[i] = BatchResult{Status: http.StatusCreated, Invoice: presentInvoice(ctx, *operation.Invoice)}
+		default:
+			results[i] = BatchResult{Status: http.StatusOK, Result: "success"}
+		}
+	}
+
+	if status == http.StatusOK {
+		for i, operation := range batch.Operations {
+			if outcomes[i] != nil {
+				continue
+			}
+			switch operation.Op {
+			case "create":
+				invoicesCreated.Inc()
+			case "delete":
+				invoicesDeleted.Inc()
+			}
+		}
+	}
+
+	Respond(response, status, map[string]interface{}{"results": results})
+})
+
+// decodeBatch decodes the body of a batch request, in the form the API
+// version of the request takes it, into batch.
+func decodeBatch(request *http.Request, batch *BatchRequest) error {
+	ctx := request.Context()
+	if apiVersion(ctx) == 0 {
+		return decodeBody(request, batch)
+	}
+
+	var v1 batchRequestV1
+	if err := decodeBody(request, &v1); err != nil {
+		return err
+	}
+
+	batch.Atomic = v1.Atomic
+	batch.Operations = make([]BatchOperation, len(v1.Operations))
+	for i, operation := range v1.Operations {
+		batch.Operations[i] = operation.BatchOperation
+		batch.Operations[i].Fields = updateFields(ctx, operation.Fields)
+		if operation.Invoice != nil {
+			invoice := operation.Invoice.Invoice()
+			batch.Operations[i].Invoice = &invoice
+		}
+	}
+
+	return nil
+}
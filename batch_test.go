@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchOperationValidate(t *testing.T) {
+	for _, test := range []struct {
+		operation BatchOperation
+		valid     bool
+	}{
+		{BatchOperation{Op: "create", Invoice: &Invoice{Document: "43210ABCD54321", CreatedAt: "2015-09-05"}}, true},
+		{BatchOperation{Op: "create", Invoice: &Invoice{Document: "short", CreatedAt: "2015-09-05"}}, false},
+		{BatchOperation{Op: "create"}, false},
+		{BatchOperation{Op: "update", Year: 2015, Month: 9, Document: "43210ABCD54321", Fields: map[string]interface{}{"Amount": 10.5}}, true},
+		{BatchOperation{Op: "update", Year: 2015, Month: 9, Document: "43210ABCD54321", Fields: map[string]interface{}{"IsActive": false}}, false},
+		{BatchOperation{Op: "update", Year: 2015, Month: 9, Document: "43210ABCD54321", Fields: map[string]interface{}{"CreatedAt": 2015}}, false},
+		{BatchOperation{Op: "delete", Year: 2015, Month: 9, Document: "43210ABCD54321"}, true},
+		{BatchOperation{Op: "delete", Year: 2015, Month: 13, Document: "43210ABCD54321"}, false},
+		{BatchOperation{Op: "upsert"}, false},
+	} {
+		err := test.operation.Validate()
+		if test.valid && err != nil {
+			t.Errorf("Expected %+v to be valid. Got %v\n", test.operation, err)
+		}
+		if !test.valid && !errors.Is(err, ErrValidation) {
+			t.Errorf("Expected %+v to be invalid. Got %v\n", test.operation, err)
+		}
+	}
+}
+
+func TestBatchOperationXML(t *testing.T) {
+	handler := RequestBody(1<<20, false)(BatchInvoicesHandler)
+
+	for _, contentType := range []string{"application/xml", "text/xml", "application/vnd.batch+xml"} {
+		request, _ := http.NewRequest("POST", "/invoices/batch", strings.NewReader(`<response><atomic>true</atomic></response>`))
+		request.Header.Set("Content-Type", contentType)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		checkResponseCode(t, http.StatusUnsupportedMediaType, response.Code)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes responses and decodes request bodies in one media type.
+type Codec interface {
+	MediaType() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(ctx context.Context, r io.Reader, v interface{}) error
+}
+
+// codecs are the media types payloads can be exchanged in, by the names
+// clients send them under. JSON is the default.
+var codecs = map[string]Codec{
+	"application/json":        jsonCodec{},
+	"application/xml":         xmlCodec{},
+	"text/xml":                xmlCodec{},
+	"application/msgpack":     msgpackCodec{},
+	"application/x-msgpack":   msgpackCodec{},
+	"application/vnd.msgpack": msgpackCodec{},
+}
+
+const codecNames = "application/json, application/xml or application/msgpack"
+
+// codecFor finds the codec of a media type, structured syntax suffixes
+// such as application/problem+json included. It returns nil for anything
+// else.
+func codecFor(mediaType string) Codec {
+	if codec, ok := codecs[mediaType]; ok {
+		return codec
+	}
+
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		return jsonCodec{}
+	case strings.HasSuffix(mediaType, "+xml"):
+		return xmlCodec{}
+	}
+
+	return nil
+}
+
+// mediaRange is a media range of an Accept header with its quality.
+type mediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// acceptRanges parses an Accept header into the ranges it accepts, most
+// preferred first. Ranges with a quality of 0 are left out.
+func acceptRanges(accept string) []mediaRange {
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, mediaRange{mediaType, quality})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+	return ranges
+}
+
+// negotiate picks what to answer an Accept header with: a codec, or one
+// of formats, the media types the handler produces itself. Preference goes
+// by quality, then by order. Without an Accept header it's JSON; with
+// nothing acceptable, both results are empty.
+func negotiate(accept string, formats []string) (Codec, string) {
+	if strings.TrimSpace(accept) == "" {
+		return jsonCodec{}, ""
+	}
+
+	for _, r := range acceptRanges(accept) {
+		for _, format := range formats {
+			if r.mediaType == format {
+				return nil, format
+			}
+		}
+
+		if r.mediaType == "*/*" || r.mediaType == "application/*" {
+			return jsonCodec{}, ""
+		}
+		if codec := codecFor(r.mediaType); codec != nil {
+			return codec, ""
+		}
+	}
+
+	return nil, ""
+}
+
+// negotiateFormat picks which of formats to answer an Accept header with,
+// wildcards included, the first being the default. It returns "" when none
+// is acceptable.
+func negotiateFormat(accept string, formats []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return formats[0]
+	}
+
+	for _, r := range acceptRanges(accept) {
+		for _, format := range formats {
+			if r.mediaType == format || r.mediaType == "*/*" ||
+				strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(format, strings.TrimSuffix(r.mediaType, "*")) {
+				return format
+			}
+		}
+	}
+
+	return ""
+}
+
+// codecWriter carries what Negotiate chose for a response down to Respond
+// and the handler: the codec, and the format when one of the handler's own
+// won.
+type codecWriter struct {
+	http.ResponseWriter
+	codec  Codec
+	format string
+}
+
+func (w *codecWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// negotiated finds the codecWriter Negotiate wrapped w in, if any.
+func negotiated(w http.ResponseWriter) *codecWriter {
+	for {
+		switch writer := w.(type) {
+		case *codecWriter:
+			return writer
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// responseCodec finds the codec Negotiate chose for w, JSON if none.
+func responseCodec(w http.ResponseWriter) Codec {
+	if writer := negotiated(w); writer != nil {
+		return writer.codec
+	}
+
+	return jsonCodec{}
+}
+
+// responseFormat is the format of its own Negotiate chose for the handler
+// writing to w, empty when a codec won.
+func responseFormat(w http.ResponseWriter) string {
+	if writer := negotiated(w); writer != nil {
+		return writer.format
+	}
+
+	return ""
+}
+
+// Negotiate answers 406 to requests that accept none of the codecs nor any
+// of formats, the media types the handler produces by itself, and has
+// Respond encode in the codec preferred otherwise. When a format wins the
+// handler is on its own, and errors go out as JSON.
+func Negotiate(formats ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Header().Add("Vary", "Accept")
+
+			codec, format := negotiate(request.Header.Get("Accept"), formats)
+			if codec == nil && format == "" {
+				acceptable := codecNames
+				if len(formats) > 0 {
+					acceptable = strings.Join(formats, ", ") + ", " + acceptable
+				}
+				RespondWithError(response, http.StatusNotAcceptable, "Responses are available as "+acceptable)
+				return
+			}
+			if codec == nil {
+				codec = jsonCodec{}
+			}
+
+			next.ServeHTTP(&codecWriter{response, codec, format}, request)
+		})
+	}
+}
+
+// NegotiateFormats is Negotiate for handlers that only produce formats,
+// none of the codecs, so a codec the client prefers can't shadow one of
+// them. Errors go out as JSON.
+func NegotiateFormats(formats ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.Header().Add("Vary", "Accept")
+
+			format := negotiateFormat(request.Header.Get("Accept"), formats)
+			if format == "" {
+				RespondWithError(response, http.StatusNotAcceptable, "Responses are available as "+strings.Join(formats, ", "))
+				return
+			}
+
+			next.ServeHTTP(&codecWriter{response, jsonCodec{}, format}, request)
+		})
+	}
+}
+
+// requestCodec is the codec of the request's Content-Type, JSON when there
+// is none. It returns nil for types no codec reads.
+func requestCodec(request *http.Request) Codec {
+	contentType := request.Header.Get("Content-Type")
+	if contentType == "" {
+		return jsonCodec{}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	return codecFor(mediaType)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) MediaType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func (jsonCodec) Decode(ctx context.Context, r io.Reader, v interface{}) error {
+	return decodeJSON(ctx, r, v)
+}
+
+// xmlCodec has no maps to work with: a map goes out as a <response>
+// element with a child per key, in key order, and a slice as a <list> of
+// its elements. Into a map, it decodes the text of the root's children.
+type xmlCodec struct{}
+
+func (xmlCodec) MediaType() string {
+	return "application/xml"
+}
+
+func (xmlCodec) Encode(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	value := reflect.ValueOf(v)
+
+	switch value.Kind() {
+	case reflect.Map:
+		start := xml.StartElement{Name: xml.Name{Local: "response"}}
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		for _, key := range keys {
+			element := xml.StartElement{Name: xml.Name{Local: key.String()}}
+			if err := encoder.EncodeElement(value.MapIndex(key).Interface(), element); err != nil {
+				return err
+			}
+		}
+
+		if err := encoder.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	case reflect.Slice, reflect.Array:
+		start := xml.StartElement{Name: xml.Name{Local: "list"}}
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+
+		for i := 0; i < value.Len(); i++ {
+			if err := encoder.Encode(value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+
+		if err := encoder.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	default:
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+	}
+
+	return encoder.Flush()
+}
+
+func (xmlCodec) Decode(ctx context.Context, r io.Reader, v interface{}) error {
+	decoder := xml.NewDecoder(r)
+
+	fields, ok := v.(*map[string]interface{})
+	if !ok {
+		return bodyError(decoder.Decode(v))
+	}
+
+	var root struct {
+		Fields []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if err := decoder.Decode(&root); err != nil {
+		return bodyError(err)
+	}
+
+	*fields = make(map[string]interface{}, len(root.Fields))
+	for _, field := range root.Fields {
+		(*fields)[field.XMLName.Local] = field.Value
+	}
+
+	return nil
+}
+
+// msgpackCodec names fields after their JSON tags, so both formats agree.
+// It decodes through JSON, which has the strict mode and converts numbers
+// into whatever the field holds.
+type msgpackCodec struct{}
+
+func (msgpackCodec) MediaType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+
+	return encoder.Encode(v)
+}
+
+func (msgpackCodec) Decode(ctx context.Context, r io.Reader, v interface{}) error {
+	decoder := msgpack.NewDecoder(r)
+
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return bodyError(err)
+	}
+	if _, err := decoder.PeekCode(); err != io.EOF {
+		return bodyError(ErrTrailingData)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return decodeJSON(ctx, bytes.NewReader(data), v)
+}
+
+// Respond writes payload in the codec negotiated for the request, JSON if
+// none was.
+func Respond(w http.ResponseWriter, code int, payload interface{}) {
+	codec := responseCodec(w)
+
+	var body bytes.Buffer
+	if err := codec.Encode(&body, payload); err != nil {
+		// Not every payload fits every format; JSON still beats no answer
+		slog.Error("encoding response", "media_type", codec.MediaType(), "error", err)
+		codec = jsonCodec{}
+		body.Reset()
+		codec.Encode(&body, payload)
+	}
+
+	w.Header().Set("Content-Type", codec.MediaType())
+	w.WriteHeader(code)
+	w.Write(body.Bytes())
+}
+
+// decodeBody decodes request's body, in the codec of its Content-Type, into
+// v.
+func decodeBody(request *http.Request, v interface{}) error {
+	codec := requestCodec(request)
+	if codec == nil {
+		codec = jsonCodec{}
+	}
+
+	return codec.Decode(request.Context(), request.Body, v)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiate(t *testing.T) {
+	formats := []string{"text/csv"}
+
+	for accept, expected := range map[string]string{
+		"":                      "application/json",
+		"*/*":                   "application/json",
+		"application/xml":       "application/xml",
+		"text/xml":              "application/xml",
+		"application/x-msgpack": "application/msgpack",
+		"application/xml;q=0.5, application/msgpack": "application/msgpack",
+		"application/problem+json":                   "application/json",
+		"text/csv, application/json":                 "text/csv",
+		"image/png":                                  "",
+		"application/json;q=0":                       "",
+	} {
+		codec, format := negotiate(accept, formats)
+		if codec != nil {
+			format = codec.MediaType()
+		}
+		if format != expected {
+			t.Errorf("Expected %q for Accept %q. Got %q\n", expected, accept, format)
+		}
+	}
+}
+
+func TestNegotiateRespond(t *testing.T) {
+	handler := Negotiate()(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		Respond(response, http.StatusOK, []Invoice{{Document: "12345678901234", Amount: 10.5}})
+	}))
+
+	for accept, expected := range map[string]string{
+		"application/json": `[{"ReferenceMonth":0,"ReferenceYear":0,"Document":"12345678901234"`,
+		"application/xml":  `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<list><Invoice><ReferenceMonth>0</ReferenceMonth>`,
+		"image/png":        `{"code":"not_acceptable"`,
+	} {
+		request, _ := http.NewRequest("GET", "/invoices", nil)
+		request.Header.Set("Accept", accept)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		if !strings.HasPrefix(response.Body.String(), expected) {
+			t.Errorf("Expected %s for Accept %s. Got %s\n", expected, accept, response.Body.String())
+		}
+	}
+}
+
+func TestXMLCodec(t *testing.T) {
+	var body bytes.Buffer
+	if err := (xmlCodec{}).Encode(&body, map[string]string{"error": "Invoice not found", "code": "not_found"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<response><code>not_found</code><error>Invoice not found</error></response>"; !strings.HasSuffix(body.String(), expected) {
+		t.Errorf("Expected %s. Got %s\n", expected, body.String())
+	}
+
+	payload := `<Invoice><Document>12345678901234</Document><Amount>12.5</Amount></Invoice>`
+
+	var invoice Invoice
+	if err := (xmlCodec{}).Decode(context.Background(), strings.NewReader(payload), &invoice); err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Document != "12345678901234" || invoice.Amount != 12.5 || invoice.Tenant != "" {
+		t.Errorf("Unexpected invoice %+v\n", invoice)
+	}
+
+	var fields map[string]interface{}
+	if err := (xmlCodec{}).Decode(context.Background(), strings.NewReader(payload), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 2 || fields["Amount"] != "12.5" || validateUpdate(fields) != nil {
+		t.Errorf("Unexpected fields %v\n", fields)
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	var body bytes.Buffer
+	if err := (msgpackCodec{}).Encode(&body, Invoice{Tenant: "acme", Document: "12345678901234", Amount: 10.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	var encoded map[string]interface{}
+	msgpack.Unmarshal(body.Bytes(), &encoded)
+	if _, ok := encoded["Tenant"]; ok || encoded["Document"] != "12345678901234" {
+		t.Errorf("Unexpected encoding %v\n", encoded)
+	}
+
+	// Most clients send every float as a float64
+	data, _ := msgpack.Marshal(map[string]interface{}{"Document": "12345678901234", "Amount": 12.5})
+
+	var invoice Invoice
+	if err := (msgpackCodec{}).Decode(context.Background(), bytes.NewReader(data), &invoice); err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Document != "12345678901234" || invoice.Amount != 12.5 {
+		t.Errorf("Unexpected invoice %+v\n", invoice)
+	}
+
+	if err := (msgpackCodec{}).Decode(context.Background(), bytes.NewReader(append(data, data...)), &invoice); err == nil {
+		t.Error("Expected trailing data to be refused")
+	}
+}
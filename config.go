@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the service needs at startup. LoadConfig fills it from,
+// by increasing precedence: defaults, a YAML file, environment variables and
+// command line flags.
+type Config struct {
+	Server     ServerConfig    `yaml:"server"`
+	Database   DatabaseConfig  `yaml:"database"`
+	Auth       AuthConfig      `yaml:"auth"`
+	RateLimits RateLimitConfig `yaml:"rate_limits"`
+	Tracing    TracingConfig   `yaml:"tracing"`
+	Logging    LoggingConfig   `yaml:"logging"`
+	PDF        PDFConfig       `yaml:"pdf"`
+}
+
+type ServerConfig struct {
+	Listen            string        `yaml:"listen"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout bounds how long in-flight requests may take to drain
+	// after SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// MaxBodyBytes caps request bodies; larger ones get a 413
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// MaxImportBytes caps bulk imports instead
+	MaxImportBytes int64 `yaml:"max_import_bytes"`
+	// StrictJSON rejects payloads with fields the endpoint doesn't know
+	StrictJSON bool `yaml:"strict_json"`
+}
+
+type DatabaseConfig struct {
+	// URL is a full postgres:// connection URL; the settings below override
+	// the parts of it they name
+	URL         string `yaml:"url"`
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	Name        string `yaml:"name"`
+	SSLMode     string `yaml:"sslmode"`
+	SSLRootCert string `yaml:"sslrootcert"`
+	SSLCert     string `yaml:"sslcert"`
+	SSLKey      string `yaml:"sslkey"`
+
+	// ConnectTimeout bounds the connectivity check made at startup
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+
+	Timeouts QueryTimeouts `yaml:"timeouts"`
+}
+
+// QueryTimeouts bound each store operation, counted from the start of the
+// request. Zero means no timeout.
+type QueryTimeouts struct {
+	Create time.Duration `yaml:"create"`
+	Get    time.Duration `yaml:"get"`
+	Update time.Duration `yaml:"update"`
+	Delete time.Duration `yaml:"delete"`
+	Export time.Duration `yaml:"export"`
+	Import time.Duration `yaml:"import"`
+	Batch  time.Duration `yaml:"batch"`
+}
+
+type LoggingConfig struct {
+	Level slog.Level `yaml:"level"`
+	// Format is json or text
+	Format string `yaml:"format"`
+}
+
+// PDFConfig is the template of printable invoices.
+type PDFConfig struct {
+	Title string `yaml:"title"`
+	// Logo is a PNG or JPEG file printed at the top left
+	Logo           string `yaml:"logo"`
+	IssuerName     string `yaml:"issuer_name"`
+	IssuerDocument string `yaml:"issuer_document"`
+	IssuerAddress  string `yaml:"issuer_address"`
+	Footer         string `yaml:"footer"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, otlp (OTLP over HTTP), stdout or file
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP collector host:port; OTEL_EXPORTER_OTLP_* apply
+	// when empty
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	File        string  `yaml:"file"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type RateLimitConfig struct {
+	Read  RateLimit `yaml:"read"`
+	Write RateLimit `yaml:"write"`
+	Admin RateLimit `yaml:"admin"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Listen:            ":8080",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ShutdownTimeout:   20 * time.Second,
+			MaxBodyBytes:      1 << 20,
+			MaxImportBytes:    64 << 20,
+		},
+		Database: DatabaseConfig{
+			ConnectTimeout:  5 * time.Second,
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			Timeouts: QueryTimeouts{
+				Create: 5 * time.Second,
+				Get:    10 * time.Second,
+				Update: 5 * time.Second,
+				Delete: 5 * time.Second,
+				Export: 5 * time.Minute,
+				Import: 5 * time.Minute,
+				Batch:  30 * time.Second,
+			},
+		},
+		Auth: AuthConfig{
+			ClockSkew:   DefaultClockSkew,
+			TenantClaim: DefaultTenantClaim,
+		},
+		RateLimits: RateLimitConfig{
+			Read:  RateLimit{Requests: 600, Per: time.Minute},
+			Write: RateLimit{Requests: 120, Per: time.Minute},
+			Admin: RateLimit{Requests: 30, Per: time.Minute},
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "REST-in-Go",
+			SampleRatio: 1,
+		},
+		Logging: LoggingConfig{
+			Level:  slog.LevelInfo,
+			Format: "json",
+		},
+		PDF: PDFConfig{
+			Title: "Invoice",
+		},
+	}
+}
+
+// setting ties a flag to the environment variable that sets the same field.
+type setting struct {
+	flag string
+	env  string
+}
+
+// settings lists every flag bound by flagSet that can also come from the
+// environment. The database and API variables keep the names the service
+// has always read.
+var settings = []setting{
+	{"listen", "APP_LISTEN"},
+	{"read-timeout", "APP_READ_TIMEOUT"},
+	{"read-header-timeout", "APP_READ_HEADER_TIMEOUT"},
+	{"write-timeout", "APP_WRITE_TIMEOUT"},
+	{"idle-timeout", "APP_IDLE_TIMEOUT"},
+	{"shutdown-timeout", "APP_SHUTDOWN_TIMEOUT"},
+	{"max-body-bytes", "APP_MAX_BODY_BYTES"},
+	{"max-import-bytes", "APP_MAX_IMPORT_BYTES"},
+	{"strict-json", "APP_STRICT_JSON"},
+	{"db-url", "APP_DB_URL"},
+	{"db-host", "APP_DB_HOST"},
+	{"db-port", "APP_DB_PORT"},
+	{"db-user", "APP_DB_USERNAME_SANDBOX"},
+	{"db-password", "APP_DB_PASSWORD_SANDBOX"},
+	{"db-name", "APP_DB_NAME_SANDBOX"},
+	{"db-sslmode", "APP_DB_SSLMODE"},
+	{"db-sslrootcert", "APP_DB_SSLROOTCERT"},
+	{"db-sslcert", "APP_DB_SSLCERT"},
+	{"db-sslkey", "APP_DB_SSLKEY"},
+	{"db-connect-timeout", "APP_DB_CONNECT_TIMEOUT"},
+	{"db-max-open-conns", "APP_DB_MAX_OPEN_CONNS"},
+	{"db-max-idle-conns", "APP_DB_MAX_IDLE_CONNS"},
+	{"db-conn-max-lifetime", "APP_DB_CONN_MAX_LIFETIME"},
+	{"db-conn-max-idle-time", "APP_DB_CONN_MAX_IDLE_TIME"},
+	{"db-timeout-create", "APP_DB_TIMEOUT_CREATE"},
+	{"db-timeout-get", "APP_DB_TIMEOUT_GET"},
+	{"db-timeout-update", "APP_DB_TIMEOUT_UPDATE"},
+	{"db-timeout-delete", "APP_DB_TIMEOUT_DELETE"},
+	{"db-timeout-export", "APP_DB_TIMEOUT_EXPORT"},
+	{"db-timeout-import", "APP_DB_TIMEOUT_IMPORT"},
+	{"db-timeout-batch", "APP_DB_TIMEOUT_BATCH"},
+	{"auth-secret", "API_SECRET"},
+	{"auth-audience", "API_AUDIENCE"},
+	{"auth-issuer", "API_ISSUER"},
+	{"auth-clock-skew", "API_CLOCK_SKEW"},
+	{"auth-tenant-claim", "API_TENANT_CLAIM"},
+	{"auth-dev-token-issuer", "API_DEV_TOKEN_ISSUER"},
+	{"rate-limit-read", "RATE_LIMIT_READ"},
+	{"rate-limit-write", "RATE_LIMIT_WRITE"},
+	{"rate-limit-admin", "RATE_LIMIT_ADMIN"},
+	{"tracing-exporter", "APP_TRACING_EXPORTER"},
+	{"tracing-endpoint", "APP_TRACING_ENDPOINT"},
+	{"tracing-insecure", "APP_TRACING_INSECURE"},
+	{"tracing-file", "APP_TRACING_FILE"},
+	{"tracing-service-name", "APP_TRACING_SERVICE_NAME"},
+	{"tracing-sample-ratio", "APP_TRACING_SAMPLE_RATIO"},
+	{"log-level", "APP_LOG_LEVEL"},
+	{"log-format", "APP_LOG_FORMAT"},
+	{"pdf-title", "APP_PDF_TITLE"},
+	{"pdf-logo", "APP_PDF_LOGO"},
+	{"pdf-issuer-name", "APP_PDF_ISSUER_NAME"},
+	{"pdf-issuer-document", "APP_PDF_ISSUER_DOCUMENT"},
+	{"pdf-issuer-address", "APP_PDF_ISSUER_ADDRESS"},
+	{"pdf-footer", "APP_PDF_FOOTER"},
+}
+
+// flagSet binds the command line flags straight to config's fields, so
+// parsing only overrides what was actually passed.
+func (config *Config) flagSet(configPath *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("REST-in-Go", flag.ContinueOnError)
+
+	flags.StringVar(configPath, "config", *configPath, "YAML configuration file (env APP_CONFIG)")
+	flags.StringVar(&config.Server.Listen, "listen", config.Server.Listen, "address the HTTP server listens on")
+	flags.DurationVar(&config.Server.ReadTimeout, "read-timeout", config.Server.ReadTimeout, "maximum time to read a request, 0 for none")
+	flags.DurationVar(&config.Server.ReadHeaderTimeout, "read-header-timeout", config.Server.ReadHeaderTimeout, "maximum time to read request headers")
+	flags.DurationVar(&config.Server.WriteTimeout, "write-timeout", config.Server.WriteTimeout, "maximum time to write a response, 0 for none")
+	flags.DurationVar(&config.Server.IdleTimeout, "idle-timeout", config.Server.IdleTimeout, "maximum keep-alive idle time")
+	flags.DurationVar(&config.Server.ShutdownTimeout, "shutdown-timeout", config.Server.ShutdownTimeout, "time allowed to drain requests on shutdown")
+	flags.Int64Var(&config.Server.MaxBodyBytes, "max-body-bytes", config.Server.MaxBodyBytes, "maximum request body size in bytes")
+	flags.Int64Var(&config.Server.MaxImportBytes, "max-import-bytes", config.Server.MaxImportBytes, "maximum bulk import size in bytes")
+	flags.BoolVar(&config.Server.StrictJSON, "strict-json", config.Server.StrictJSON, "reject unknown fields in JSON payloads")
+
+	flags.StringVar(&config.Database.URL, "db-url", config.Database.URL, "postgres:// connection URL")
+	flags.StringVar(&config.Database.Host, "db-host", config.Database.Host, "database host or unix socket directory")
+	flags.IntVar(&config.Database.Port, "db-port", config.Database.Port, "database port")
+	flags.StringVar(&config.Database.User, "db-user", config.Database.User, "database user")
+	flags.StringVar(&config.Database.Password, "db-password", config.Database.Password, "database password")
+	flags.StringVar(&config.Database.Name, "db-name", config.Database.Name, "database name")
+	flags.StringVar(&config.Database.SSLMode, "db-sslmode", config.Database.SSLMode, "disable, require, verify-ca or verify-full")
+	flags.StringVar(&config.Database.SSLRootCert, "db-sslrootcert", config.Database.SSLRootCert, "CA certificate file")
+	flags.StringVar(&config.Database.SSLCert, "db-sslcert", config.Database.SSLCert, "client certificate file")
+	flags.StringVar(&config.Database.SSLKey, "db-sslkey", config.Database.SSLKey, "client key file")
+	flags.DurationVar(&config.Database.ConnectTimeout, "db-connect-timeout", config.Database.ConnectTimeout, "time allowed to reach the database at startup")
+	flags.IntVar(&config.Database.MaxOpenConns, "db-max-open-conns", config.Database.MaxOpenConns, "maximum open connections, 0 for no limit")
+	flags.IntVar(&config.Database.MaxIdleConns, "db-max-idle-conns", config.Database.MaxIdleConns, "maximum idle connections")
+	flags.DurationVar(&config.Database.ConnMaxLifetime, "db-conn-max-lifetime", config.Database.ConnMaxLifetime, "maximum connection lifetime, 0 for no limit")
+	flags.DurationVar(&config.Database.ConnMaxIdleTime, "db-conn-max-idle-time", config.Database.ConnMaxIdleTime, "maximum connection idle time, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Create, "db-timeout-create", config.Database.Timeouts.Create, "time allowed to create, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Get, "db-timeout-get", config.Database.Timeouts.Get, "time allowed to list, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Update, "db-timeout-update", config.Database.Timeouts.Update, "time allowed to update, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Delete, "db-timeout-delete", config.Database.Timeouts.Delete, "time allowed to delete, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Export, "db-timeout-export", config.Database.Timeouts.Export, "time allowed to export, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Import, "db-timeout-import", config.Database.Timeouts.Import, "time allowed to import, 0 for no limit")
+	flags.DurationVar(&config.Database.Timeouts.Batch, "db-timeout-batch", config.Database.Timeouts.Batch, "time allowed to run a batch, 0 for no limit")
+
+	flags.StringVar(&config.Auth.Secret, "auth-secret", config.Auth.Secret, "HS256 token secret")
+	flags.StringVar(&config.Auth.Audience, "auth-audience", config.Auth.Audience, "expected token audience")
+	flags.StringVar(&config.Auth.Issuer, "auth-issuer", config.Auth.Issuer, "expected token issuer")
+	flags.DurationVar(&config.Auth.ClockSkew, "auth-clock-skew", config.Auth.ClockSkew, "tolerance for token exp/nbf/iat")
+	flags.StringVar(&config.Auth.TenantClaim, "auth-tenant-claim", config.Auth.TenantClaim, "token claim naming the tenant")
+	flags.BoolVar(&config.Auth.DevTokenIssuer, "auth-dev-token-issuer", config.Auth.DevTokenIssuer, "serve POST /oauth/token (development only)")
+
+	flags.Var(&config.RateLimits.Read, "rate-limit-read", "rate limit of read routes, <requests>/<duration> or off")
+	flags.Var(&config.RateLimits.Write, "rate-limit-write", "rate limit of write routes, <requests>/<duration> or off")
+	flags.Var(&config.RateLimits.Admin, "rate-limit-admin", "rate limit of admin routes, <requests>/<duration> or off")
+
+	flags.StringVar(&config.Tracing.Exporter, "tracing-exporter", config.Tracing.Exporter, "span exporter: none, otlp, stdout or file")
+	flags.StringVar(&config.Tracing.Endpoint, "tracing-endpoint", config.Tracing.Endpoint, "OTLP/HTTP collector host:port")
+	flags.BoolVar(&config.Tracing.Insecure, "tracing-insecure", config.Tracing.Insecure, "send OTLP over plain HTTP")
+	flags.StringVar(&config.Tracing.File, "tracing-file", config.Tracing.File, "file the file exporter appends spans to")
+	flags.StringVar(&config.Tracing.ServiceName, "tracing-service-name", config.Tracing.ServiceName, "service.name resource attribute")
+	flags.Float64Var(&config.Tracing.SampleRatio, "tracing-sample-ratio", config.Tracing.SampleRatio, "fraction of new traces sampled")
+
+	flags.TextVar(&config.Logging.Level, "log-level", config.Logging.Level, "debug, info, warn or error")
+	flags.StringVar(&config.Logging.Format, "log-format", config.Logging.Format, "json or text")
+
+	flags.StringVar(&config.PDF.Title, "pdf-title", config.PDF.Title, "title of printable invoices")
+	flags.StringVar(&config.PDF.Logo, "pdf-logo", config.PDF.Logo, "PNG or JPEG logo of printable invoices")
+	flags.StringVar(&config.PDF.IssuerName, "pdf-issuer-name", config.PDF.IssuerName, "issuer name printed on invoices")
+	flags.StringVar(&config.PDF.IssuerDocument, "pdf-issuer-document", config.PDF.IssuerDocument, "issuer CNPJ or CPF printed on invoices")
+	flags.StringVar(&config.PDF.IssuerAddress, "pdf-issuer-address", config.PDF.IssuerAddress, "issuer address printed on invoices")
+	flags.StringVar(&config.PDF.Footer, "pdf-footer", config.PDF.Footer, "footer of printable invoices")
+
+	return flags
+}
+
+// LoadConfig builds and validates the configuration for args, the command
+// line without the program name. The file is named by -config or APP_CONFIG.
+func LoadConfig(args []string) (Config, error) {
+	config, err := loadConfig(args)
+	if err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+func loadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+
+	// First pass only finds the configuration file; its values are dropped
+	scratch := DefaultConfig()
+	configPath := os.Getenv("APP_CONFIG")
+	if err := scratch.flagSet(&configPath).Parse(args); err != nil {
+		return config, err
+	}
+
+	if configPath != "" {
+		if err := config.loadFile(configPath); err != nil {
+			return config, err
+		}
+	}
+
+	flags := config.flagSet(&configPath)
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := flags.Set(s.flag, value); err != nil {
+				return config, fmt.Errorf("invalid %s: %v", s.env, err)
+			}
+		}
+	}
+
+	err := flags.Parse(args)
+	return config, err
+}
+
+func (config *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (config Config) Validate() error {
+	if err := config.Server.Validate(); err != nil {
+		return err
+	}
+	if err := config.Database.Validate(); err != nil {
+		return err
+	}
+	if err := config.Tracing.Validate(); err != nil {
+		return err
+	}
+	if config.Logging.Format != "json" && config.Logging.Format != "text" {
+		return fmt.Errorf("logging: unknown format %q", config.Logging.Format)
+	}
+	if err := config.PDF.Validate(); err != nil {
+		return err
+	}
+
+	return config.Auth.Validate()
+}
+
+func (config ServerConfig) Validate() error {
+	if config.Listen == "" {
+		return errors.New("server: listen address must not be empty")
+	}
+	if config.ReadTimeout < 0 || config.ReadHeaderTimeout < 0 || config.WriteTimeout < 0 || config.IdleTimeout < 0 {
+		return errors.New("server: timeouts must not be negative")
+	}
+	if config.ShutdownTimeout <= 0 {
+		return errors.New("server: shutdown timeout must be positive")
+	}
+	if config.MaxBodyBytes <= 0 || config.MaxImportBytes <= 0 {
+		return errors.New("server: max body and import bytes must be positive")
+	}
+
+	return nil
+}
+
+func (config DatabaseConfig) Validate() error {
+	if config.Name == "" && config.URL == "" {
+		return errors.New("database: name or url must be set")
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("database: invalid port %d", config.Port)
+	}
+
+	switch config.SSLMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("database: unsupported sslmode %q", config.SSLMode)
+	}
+
+	if (config.SSLCert == "") != (config.SSLKey == "") {
+		return errors.New("database: sslcert and sslkey must be set together")
+	}
+	if config.MaxOpenConns < 0 || config.MaxIdleConns < 0 {
+		return errors.New("database: pool sizes must not be negative")
+	}
+	if config.ConnectTimeout <= 0 {
+		return errors.New("database: connect timeout must be positive")
+	}
+	if config.ConnMaxLifetime < 0 || config.ConnMaxIdleTime < 0 {
+		return errors.New("database: connection lifetimes must not be negative")
+	}
+	if timeouts := config.Timeouts; timeouts.Create < 0 || timeouts.Get < 0 || timeouts.Update < 0 || timeouts.Delete < 0 || timeouts.Export < 0 || timeouts.Import < 0 || timeouts.Batch < 0 {
+		return errors.New("database: timeouts must not be negative")
+	}
+
+	_, err := config.DSN()
+	return err
+}
+
+func (config PDFConfig) Validate() error {
+	if config.Logo == "" {
+		return nil
+	}
+	if _, err := logoImageType(config.Logo); err != nil {
+		return fmt.Errorf("pdf: %v", err)
+	}
+	if _, err := os.Stat(config.Logo); err != nil {
+		return fmt.Errorf("pdf: %v", err)
+	}
+
+	return nil
+}
+
+func (config TracingConfig) Validate() error {
+	switch config.Exporter {
+	case "none", "otlp", "stdout":
+	case "file":
+		if config.File == "" {
+			return errors.New("tracing: the file exporter needs a file")
+		}
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q", config.Exporter)
+	}
+
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return errors.New("tracing: sample ratio must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Limits returns the enabled limits by route class.
+func (config RateLimitConfig) Limits() map[string]RateLimit {
+	limits := make(map[string]RateLimit)
+
+	for class, limit := range map[string]RateLimit{
+		RouteClassRead:  config.Read,
+		RouteClassWrite: config.Write,
+		RouteClassAdmin: config.Admin,
+	} {
+		if limit.Requests > 0 {
+			limits[class] = limit
+		}
+	}
+
+	return limits
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  listen: ":9000"
+database:
+  user: file_user
+  name: file_db
+auth:
+  secret: file_secret
+  issuer: https://file/
+  audience: https://invoices/
+  clock_skew: 30s
+rate_limits:
+  write: 10/1s
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("APP_CONFIG", path)
+	t.Setenv("APP_DB_NAME_SANDBOX", "env_db")
+	t.Setenv("API_ISSUER", "https://env/")
+	t.Setenv("RATE_LIMIT_ADMIN", "off")
+
+	config, err := LoadConfig([]string{"-auth-issuer", "https://flag/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DefaultConfig()
+	expected.Server.Listen = ":9000"
+	expected.Database.User = "file_user"
+	expected.Database.Name = "env_db"
+	expected.Auth.Secret = "file_secret"
+	expected.Auth.Issuer = "https://flag/"
+	expected.Auth.Audience = "https://invoices/"
+	expected.Auth.ClockSkew = 30 * time.Second
+	expected.RateLimits.Write = RateLimit{Requests: 10, Per: time.Second}
+	expected.RateLimits.Admin = RateLimit{}
+
+	if config != expected {
+		t.Errorf("Unexpected configuration:\n%+v\nexpected:\n%+v\n", config, expected)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+	t.Setenv("APP_CONFIG", "")
+
+	if _, err := LoadConfig([]string{"-db-name", "db", "-auth-issuer", "https://issuer/"}); err == nil {
+		t.Errorf("An empty auth secret was accepted\n")
+	}
+
+	if _, err := LoadConfig([]string{"-db-name", "db", "-auth-secret", "s", "-auth-issuer", "https://issuer/"}); err == nil {
+		t.Errorf("An empty auth audience was accepted\n")
+	}
+
+	t.Setenv("API_CLOCK_SKEW", "soon")
+	if _, err := LoadConfig([]string{"-db-name", "db", "-auth-secret", "s", "-auth-issuer", "https://issuer/", "-auth-audience", "https://invoices/"}); err == nil {
+		t.Errorf("An invalid API_CLOCK_SKEW was accepted\n")
+	}
+}
+
+func TestConfigSettingsHaveFlags(t *testing.T) {
+	config := DefaultConfig()
+	configPath := ""
+	flags := config.flagSet(&configPath)
+
+	for _, s := range settings {
+		if flags.Lookup(s.flag) == nil {
+			t.Errorf("%s is bound to the unknown flag -%s\n", s.env, s.flag)
+		}
+	}
+}
+
+func TestDatabaseDSN(t *testing.T) {
+	for _, test := range []struct {
+		config   DatabaseConfig
+		expected string
+	}{
+		{
+			DatabaseConfig{User: "invoice", Password: "it's a secret", Name: "invoices"},
+			`sslmode=disable user='invoice' password='it\'s a secret' dbname='invoices'`,
+		},
+		{
+			DatabaseConfig{Host: "db.internal", Port: 6432, Name: "invoices", SSLMode: "verify-full", SSLRootCert: "/etc/ca.pem"},
+			`host='db.internal' port='6432' dbname='invoices' sslmode='verify-full' sslrootcert='/etc/ca.pem'`,
+		},
+		{
+			DatabaseConfig{URL: "postgres://invoice@db.internal:5433/invoices?sslmode=require", Password: "secret"},
+			`dbname='invoices' host='db.internal' port='5433' sslmode='require' user='invoice' password='secret'`,
+		},
+	} {
+		dsn, err := test.config.DSN()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dsn != test.expected {
+			t.Errorf("Expected DSN %s. Got %s\n", test.expected, dsn)
+		}
+	}
+}
@@ -2,62 +2,148 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var dbConnection *sql.DB
 
-func ConnectDatabase(username, password, dbname string) error {
+func ConnectDatabase(config DatabaseConfig) error {
 
-	connectionString :=
-		fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", username, password, dbname)
+	connectionString, err := config.DSN()
+	if err != nil {
+		return err
+	}
 
-	var err error
 	dbConnection, err = sql.Open("postgres", connectionString)
+	if err != nil {
+		return err
+	}
+
+	dbConnection.SetMaxOpenConns(config.MaxOpenConns)
+	dbConnection.SetMaxIdleConns(config.MaxIdleConns)
+	dbConnection.SetConnMaxLifetime(config.ConnMaxLifetime)
+	dbConnection.SetConnMaxIdleTime(config.ConnMaxIdleTime)
 
-	return err
+	return nil
 }
 
-var CreateInvoiceHandler = AuthMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+// DSN builds the lib/pq connection string. When URL is set it is the base,
+// and any individual setting given as well overrides the matching part of
+// it. Without a URL, sslmode defaults to disable as it always has.
+func (config DatabaseConfig) DSN() (string, error) {
+	var parts []string
 
-	var invoice Invoice
-	decoder := json.NewDecoder(request.Body)
+	if config.URL != "" {
+		base, err := pq.ParseURL(config.URL)
+		if err != nil {
+			return "", fmt.Errorf("database: invalid url: %v", err)
+		}
+		parts = append(parts, base)
+	} else if config.SSLMode == "" {
+		parts = append(parts, "sslmode=disable")
+	}
 
-	if err := decoder.Decode(&invoice); err != nil {
-		RespondWithError(response, http.StatusBadRequest, "Invalid request payload")
-		return
+	for _, option := range []struct{ key, value string }{
+		{"host", config.Host},
+		{"port", portString(config.Port)},
+		{"user", config.User},
+		{"password", config.Password},
+		{"dbname", config.Name},
+		{"sslmode", config.SSLMode},
+		{"sslrootcert", config.SSLRootCert},
+		{"sslcert", config.SSLCert},
+		{"sslkey", config.SSLKey},
+	} {
+		if option.value != "" {
+			parts = append(parts, option.key+"="+quoteDSNValue(option.value))
+		}
 	}
-	defer request.Body.Close()
 
-	today := time.Now().Unix()
-	createdAt, err := time.Parse("2006-01-02", invoice.CreatedAt)
+	return strings.Join(parts, " "), nil
+}
 
-	if err != nil || len(invoice.Document) != 14 || len(invoice.Description) > 256 || createdAt.Unix() > today {
-		RespondWithError(response, http.StatusBadRequest, "Invalid request payload")
+func portString(port int) string {
+	if port == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(port)
+}
+
+// quoteDSNValue quotes value as a libpq keyword/value connection string
+// expects, so passwords with spaces or quotes survive.
+func quoteDSNValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + replacer.Replace(value) + "'"
+}
+
+// tenantFromRequest returns the tenant of the authenticated caller. Every
+// invoice route runs behind AuthMiddleware, so a principal is always present.
+func tenantFromRequest(request *http.Request) string {
+	principal, _ := PrincipalFromContext(request.Context())
+	return principal.Tenant
+}
+
+// QueryTimeout bounds the context of the requests to next by timeout, so a
+// slow query is cancelled in Postgres instead of left running. Zero means no
+// timeout.
+func QueryTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			ctx, cancel := context.WithTimeout(request.Context(), timeout)
+			defer cancel()
+
+			next.ServeHTTP(response, request.WithContext(ctx))
+		})
+	}
+}
+
+var CreateInvoiceHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "CreateInvoiceHandler")
+	defer span.End()
+
+	invoice, err := decodeInvoice(ctx, requestCodec(request), request.Body)
+	if err != nil {
+		respondWithBodyError(response, err)
 		return
 	}
 
-	if err := invoice.CreateInvoice(dbConnection); err != nil {
-		RespondWithError(response, http.StatusInternalServerError, err.Error())
+	if err := invoice.Validate(); err != nil {
+		RespondWithError(response, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	RespondWithJSON(response, http.StatusCreated, invoice)
-}))
+	invoice.Tenant = tenantFromRequest(request)
+	if err := invoice.CreateInvoice(ctx, dbConnection); err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
+	}
+	invoicesCreated.Inc()
 
-var GetInvoicesHandler = AuthMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	Respond(response, http.StatusCreated, presentInvoice(ctx, invoice))
+})
 
+// invoiceQuery builds the createSelectStatement parameters shared by listings,
+// exports and summaries: the caller's tenant, the year/month/document filters
+// from the path or else the query string, the active/deleted status and the
+// order.
+func invoiceQuery(request *http.Request) map[string]interface{} {
 	sqlParams, where := make(map[string]interface{}), mux.Vars(request)
-	limit, err := strconv.Atoi(request.FormValue("per_page"))
+	sqlParams["tenant"] = tenantFromRequest(request)
 
 	if len(where) == 0 {
 		for k, v := range request.URL.Query() {
@@ -67,6 +153,31 @@ var GetInvoicesHandler = AuthMiddleware(http.HandlerFunc(func(response http.Resp
 		}
 	}
 
+	orderby := request.URL.Query()["order"]
+
+	if status := request.URL.Query().Get("status"); status == "active" || status == "deleted" {
+		sqlParams["status"] = status
+	}
+
+	if len(where) > 0 {
+		sqlParams["where"] = where
+	}
+
+	if len(orderby) > 0 {
+		sqlParams["orderby"] = orderby
+	}
+
+	return sqlParams
+}
+
+var GetInvoicesHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "GetInvoicesHandler")
+	defer span.End()
+
+	sqlParams := invoiceQuery(request)
+	limit, err := strconv.Atoi(request.FormValue("per_page"))
+
 	if err != nil || limit > 400 || limit < 1 {
 		limit = 100
 	}
@@ -78,26 +189,50 @@ var GetInvoicesHandler = AuthMiddleware(http.HandlerFunc(func(response http.Resp
 	}
 	sqlParams["offset"] = offset * limit
 
-	orderby := request.URL.Query()["order"]
-
-	if len(where) > 0 {
-		sqlParams["where"] = where
+	invoices, err := GetInvoices(ctx, dbConnection, sqlParams)
+	if err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
 	}
 
-	if len(orderby) > 0 {
-		sqlParams["orderby"] = orderby
+	Respond(response, http.StatusOK, presentInvoices(ctx, invoices))
+})
+
+var SummarizeInvoicesHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "SummarizeInvoicesHandler")
+	defer span.End()
+
+	var groupBy []string
+	seen := make(map[string]bool)
+
+	for _, value := range request.URL.Query()["group_by"] {
+		for _, group := range strings.Split(value, ",") {
+			group = strings.TrimSpace(group)
+			if group != "year" && group != "month" && group != "document" {
+				RespondWithError(response, http.StatusBadRequest, "group_by takes year, month and document")
+				return
+			}
+			if !seen[group] {
+				seen[group] = true
+				groupBy = append(groupBy, group)
+			}
+		}
 	}
 
-	invoices, err := GetInvoices(dbConnection, sqlParams)
+	summaries, err := SummarizeInvoices(ctx, dbConnection, invoiceQuery(request), groupBy)
 	if err != nil {
-		RespondWithError(response, http.StatusInternalServerError, err.Error())
+		respondWithStoreError(response, request, "Invoice", err)
 		return
 	}
 
-	RespondWithJSON(response, http.StatusOK, invoices)
-}))
+	Respond(response, http.StatusOK, summaries)
+})
+
+var UpdateInvoiceHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
 
-var UpdateInvoiceHandler = AuthMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	ctx, span := tracer.Start(request.Context(), "UpdateInvoiceHandler")
+	defer span.End()
 
 	vars := mux.Vars(request)
 
@@ -111,26 +246,40 @@ var UpdateInvoiceHandler = AuthMiddleware(http.HandlerFunc(func(response http.Re
 	}
 
 	var fieldsToUpdate map[string]interface{}
-	var invoice Invoice
-	data, errIO := ioutil.ReadAll(request.Body)
-	errJ := json.Unmarshal(data, &fieldsToUpdate)
-	decoder := json.NewDecoder(bytes.NewReader(data))
+	invoice := Invoice{Tenant: tenantFromRequest(request)}
+	codec := requestCodec(request)
+	data, err := readBody(request)
+	if err == nil {
+		// Only for the type checks and, in strict mode, unknown fields
+		_, err = decodeInvoice(ctx, codec, bytes.NewReader(data))
+	}
+	if err == nil {
+		err = codec.Decode(ctx, bytes.NewReader(data), &fieldsToUpdate)
+	}
 
-	if errD := decoder.Decode(&invoice); errD != nil || errIO != nil || errJ != nil {
-		RespondWithError(response, http.StatusBadRequest, "Invalid resquest payload")
+	if err != nil {
+		respondWithBodyError(response, err)
+		return
+	}
+	fieldsToUpdate = updateFields(ctx, fieldsToUpdate)
+
+	if err := validateUpdate(fieldsToUpdate); err != nil {
+		RespondWithError(response, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	defer request.Body.Close()
 
-	if err := invoice.UpdateInvoice(dbConnection, month, year, document, fieldsToUpdate); err != nil {
-		RespondWithError(response, http.StatusInternalServerError, err.Error())
+	if err := invoice.UpdateInvoice(ctx, dbConnection, month, year, document, fieldsToUpdate); err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
 		return
 	}
 
-	RespondWithJSON(response, http.StatusOK, map[string]string{"result": "success"})
-}))
+	Respond(response, http.StatusOK, map[string]string{"result": "success"})
+})
 
-var DeleteInvoiceHandler = AuthMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+var DeleteInvoiceHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "DeleteInvoiceHandler")
+	defer span.End()
 
 	vars := mux.Vars(request)
 
@@ -143,11 +292,104 @@ var DeleteInvoiceHandler = AuthMiddleware(http.HandlerFunc(func(response http.Re
 		return
 	}
 
-	invoice := Invoice{ReferenceMonth: month, ReferenceYear: year, Document: document}
-	if err := invoice.DeleteInvoice(dbConnection); err != nil {
-		RespondWithError(response, http.StatusInternalServerError, err.Error())
+	invoice := Invoice{Tenant: tenantFromRequest(request), ReferenceMonth: month, ReferenceYear: year, Document: document}
+	if err := invoice.DeleteInvoice(ctx, dbConnection); err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
+	}
+	invoicesDeleted.Inc()
+
+	Respond(response, http.StatusOK, map[string]string{"result": "success"})
+})
+
+var CreateAPIKeyHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "CreateAPIKeyHandler")
+	defer span.End()
+
+	var key APIKey
+	var err error
+	if apiVersion(ctx) == 0 {
+		err = decodeBody(request, &key)
+	} else {
+		var input APIKeyV1
+		err = decodeBody(request, &input)
+		key = APIKey{Owner: input.Owner, Scopes: input.Scopes}
+	}
+	if err != nil {
+		respondWithBodyError(response, err)
+		return
+	}
+
+	if key.Owner == "" || len(key.Owner) > 256 {
+		RespondWithError(response, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	key.Tenant = tenantFromRequest(request)
+	plain, err := key.CreateAPIKey(ctx, dbConnection)
+	if err != nil {
+		respondWithStoreError(response, request, "API key", err)
+		return
+	}
+
+	// The plain key is only ever returned here
+	if apiVersion(ctx) != 0 {
+		created := apiKeyV1(key)
+		created.Key = plain
+		Respond(response, http.StatusCreated, created)
+		return
+	}
+	Respond(response, http.StatusCreated, struct {
+		APIKey
+		Key string
+	}{key, plain})
+})
+
+var GetAPIKeysHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "GetAPIKeysHandler")
+	defer span.End()
+
+	keys, err := GetAPIKeys(ctx, dbConnection, tenantFromRequest(request))
+	if err != nil {
+		respondWithStoreError(response, request, "API key", err)
+		return
+	}
+
+	if apiVersion(ctx) != 0 {
+		v1 := make([]APIKeyV1, len(keys))
+		for i, key := range keys {
+			v1[i] = apiKeyV1(key)
+		}
+		Respond(response, http.StatusOK, v1)
+		return
+	}
+
+	Respond(response, http.StatusOK, keys)
+})
+
+var RevokeAPIKeyHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "RevokeAPIKeyHandler")
+	defer span.End()
+
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		RespondWithError(response, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+
+	revoked, err := RevokeAPIKey(ctx, dbConnection, tenantFromRequest(request), id)
+	if err != nil {
+		respondWithStoreError(response, request, "API key", err)
+		return
+	}
+
+	if !revoked {
+		RespondWithError(response, http.StatusNotFound, "API key not found")
 		return
 	}
 
-	RespondWithJSON(response, http.StatusOK, map[string]string{"result": "success"})
-}))
+	Respond(response, http.StatusOK, map[string]string{"result": "success"})
+})
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// Domain errors the store reports. Whatever the driver said is kept behind
+// them for the logs, but only these ever reach a client.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrValidation  = errors.New("invalid")
+	ErrUnavailable = errors.New("unavailable")
+	ErrTimeout     = errors.New("timeout")
+)
+
+// ValidationError says what is wrong with a payload. It is an ErrValidation.
+type ValidationError struct {
+	Reason string
+}
+
+func (err *ValidationError) Error() string {
+	return err.Reason
+}
+
+func (err *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// errorCodes are the machine readable codes sent along with error messages.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusFailedDependency:      "failed_dependency",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+// StoreError is a driver error classified as one of the domain errors.
+type StoreError struct {
+	Kind error
+	Err  error
+}
+
+func (err *StoreError) Error() string {
+	return err.Kind.Error() + ": " + err.Err.Error()
+}
+
+func (err *StoreError) Unwrap() []error {
+	return []error{err.Kind, err.Err}
+}
+
+// classifyError maps an error from database/sql or lib/pq to a StoreError.
+// Errors that already are domain errors are returned as they are, and
+// anything unexpected is left unclassified, to be reported as internal.
+func classifyError(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) ||
+		errors.Is(err, ErrValidation) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout) {
+		return err
+	}
+
+	var kind error
+	var pqErr *pq.Error
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		kind = ErrTimeout
+	case errors.Is(err, context.Canceled):
+		// The client went away
+		kind = ErrUnavailable
+	case errors.Is(err, sql.ErrNoRows):
+		kind = ErrNotFound
+	case errors.As(err, &pqErr):
+		switch {
+		case pqErr.Code == "23505":
+			// unique_violation
+			kind = ErrConflict
+		case pqErr.Code.Class() == "22", pqErr.Code.Class() == "23":
+			// data_exception, integrity_constraint_violation
+			kind = ErrValidation
+		case pqErr.Code.Class() == "08", pqErr.Code.Class() == "53", pqErr.Code.Class() == "57":
+			// connection_exception, insufficient_resources, operator_intervention
+			kind = ErrUnavailable
+		}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netErr):
+		kind = ErrUnavailable
+	}
+
+	if kind == nil {
+		return err
+	}
+
+	return &StoreError{Kind: kind, Err: err}
+}
+
+// respondWithStoreError answers with a sanitized message about resource for
+// err, and logs the full error with the request ID so the two can be matched.
+func respondWithStoreError(response http.ResponseWriter, request *http.Request, resource string, err error) {
+	status, message := storeErrorResponse(request.Context(), resource, err)
+	RespondWithError(response, status, message)
+}
+
+// storeErrorResponse logs err and tells the status and sanitized message to
+// answer it with. Our own validation reasons are safe to pass on as they are.
+func storeErrorResponse(ctx context.Context, resource string, err error) (int, string) {
+	// A statement cancelled along with its request comes back as whatever the
+	// driver made of it; the context tells what really happened
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		err = fmt.Errorf("%w: %w", ctxErr, err)
+	}
+
+	err = classifyError(err)
+	logger := LoggerFromContext(ctx)
+
+	var validationErr *ValidationError
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		logger.Info("store error", "resource", resource, "error", err)
+		return http.StatusNotFound, resource + " not found"
+	case errors.Is(err, ErrConflict):
+		logger.Info("store error", "resource", resource, "error", err)
+		return http.StatusConflict, resource + " already exists"
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest, validationErr.Reason
+	case errors.Is(err, ErrValidation):
+		logger.Info("store error", "resource", resource, "error", err)
+		return http.StatusBadRequest, "Invalid request payload"
+	case errors.Is(err, ErrUnavailable):
+		logger.Error("store error", "resource", resource, "error", err)
+		return http.StatusServiceUnavailable, "Service temporarily unavailable"
+	case errors.Is(err, ErrTimeout):
+		logger.Warn("store error", "resource", resource, "error", err)
+		return http.StatusGatewayTimeout, "Request timed out"
+	default:
+		logger.Error("store error", "resource", resource, "error", err)
+		return http.StatusInternalServerError, "Internal server error"
+	}
+}
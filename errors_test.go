@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected error
+	}{
+		{sql.ErrNoRows, ErrNotFound},
+		{&pq.Error{Code: "23505"}, ErrConflict},
+		{&pq.Error{Code: "23502"}, ErrValidation},
+		{&pq.Error{Code: "22001"}, ErrValidation},
+		{&pq.Error{Code: "08006"}, ErrUnavailable},
+		{&pq.Error{Code: "57P01"}, ErrUnavailable},
+		{fmt.Errorf("query: %w", driver.ErrBadConn), ErrUnavailable},
+		{ErrNotFound, ErrNotFound},
+	} {
+		if err := classifyError(test.err); !errors.Is(err, test.expected) {
+			t.Errorf("Expected %v to be classified as %v. Got %v\n", test.err, test.expected, err)
+		}
+	}
+
+	if err := classifyError(&pq.Error{Code: "42P01"}); errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected an undefined table to stay unclassified. Got %v\n", err)
+	}
+}
+
+func TestRespondWithStoreError(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	response := httptest.NewRecorder()
+	respondWithStoreError(response, request, "Invoice", &pq.Error{Code: "42703", Message: `column "amout" does not exist`})
+
+	checkResponseCode(t, http.StatusInternalServerError, response.Code)
+	if body := response.Body.String(); strings.Contains(body, "amout") || !strings.Contains(body, `"code":"internal"`) {
+		t.Errorf("Unexpected error body: %s\n", body)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	handler := QueryTimeout(time.Millisecond)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		<-request.Context().Done()
+		// What lib/pq reports for a statement cancelled by its context
+		respondWithStoreError(response, request, "Invoice", &pq.Error{Code: "57014", Message: "canceling statement due to user request"})
+	}))
+
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	checkResponseCode(t, http.StatusGatewayTimeout, response.Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request.WithContext(ctx))
+
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+}
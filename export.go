@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// exportFlushEvery is how many rows go out between flushes, so the client
+// sees the export progress instead of the whole of it at the end.
+const exportFlushEvery = 500
+
+var (
+	exportHeader   = []string{"ReferenceMonth", "ReferenceYear", "Document", "Description", "Amount", "IsActive", "CreatedAt", "DeactiveAt"}
+	exportHeaderV1 = []string{"reference_month", "reference_year", "document", "description", "amount", "is_active", "created_at", "deactivated_at"}
+)
+
+// invoiceEncoder writes invoices one at a time in an export format.
+type invoiceEncoder interface {
+	Encode(invoice Invoice) error
+	Flush() error
+}
+
+type csvInvoiceEncoder struct {
+	writer      *csv.Writer
+	header      []string
+	brl         bool
+	wroteHeader bool
+}
+
+func newCSVInvoiceEncoder(w io.Writer, delimiter rune, brl bool) *csvInvoiceEncoder {
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+
+	return &csvInvoiceEncoder{writer: writer, header: exportHeader, brl: brl}
+}
+
+func (encoder *csvInvoiceEncoder) Encode(invoice Invoice) error {
+	return encoder.write(invoice)
+}
+
+// write writes invoice followed by the extra columns the header names.
+func (encoder *csvInvoiceEncoder) write(invoice Invoice, extra ...string) error {
+	if !encoder.wroteHeader {
+		encoder.wroteHeader = true
+		if err := encoder.writer.Write(encoder.header); err != nil {
+			return err
+		}
+	}
+
+	return encoder.writer.Write(append([]string{
+		strconv.Itoa(invoice.ReferenceMonth),
+		strconv.Itoa(invoice.ReferenceYear),
+		invoice.Document,
+		invoice.Description,
+		encoder.formatAmount(float64(invoice.Amount)),
+		strconv.FormatBool(invoice.IsActive),
+		exportDate(invoice.CreatedAt),
+		exportDate(invoice.DeactiveAt),
+	}, extra...))
+}
+
+func (encoder *csvInvoiceEncoder) formatAmount(amount float64) string {
+	formatted := strconv.FormatFloat(amount, 'f', 2, 64)
+	if encoder.brl {
+		return formatBRL(formatted)
+	}
+
+	return formatted
+}
+
+// Flush also writes the header of an export without rows.
+func (encoder *csvInvoiceEncoder) Flush() error {
+	if !encoder.wroteHeader {
+		encoder.wroteHeader = true
+		encoder.writer.Write(encoder.header)
+	}
+
+	encoder.writer.Flush()
+	return encoder.writer.Error()
+}
+
+type ndjsonInvoiceEncoder struct {
+	encoder *json.Encoder
+	ctx     context.Context
+}
+
+func (encoder ndjsonInvoiceEncoder) Encode(invoice Invoice) error {
+	return encoder.encoder.Encode(presentInvoice(encoder.ctx, invoice))
+}
+
+func (encoder ndjsonInvoiceEncoder) Flush() error {
+	return nil
+}
+
+// csvHeader is the header of CSV exports in the API version of ctx.
+func csvHeader(ctx context.Context) []string {
+	if apiVersion(ctx) == 0 {
+		return exportHeader
+	}
+
+	return exportHeaderV1
+}
+
+// exportDate renders the dates of an invoice as YYYY-MM-DD, whether the
+// driver handed them over as a time or as an RFC 3339 string.
+func exportDate(value interface{}) string {
+	switch date := value.(type) {
+	case time.Time:
+		return date.Format("2006-01-02")
+	case string:
+		if len(date) > 10 {
+			return date[:10]
+		}
+		return date
+	default:
+		return ""
+	}
+}
+
+// formatBRL turns a plain decimal such as -1234567.89 into the Brazilian
+// -1.234.567,89.
+func formatBRL(amount string) string {
+	sign := ""
+	if strings.HasPrefix(amount, "-") {
+		sign, amount = "-", amount[1:]
+	}
+
+	integer, fraction, _ := strings.Cut(amount, ".")
+
+	var grouped strings.Builder
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			grouped.WriteByte('.')
+		}
+		grouped.WriteRune(digit)
+	}
+
+	if fraction == "" {
+		return sign + grouped.String()
+	}
+
+	return sign + grouped.String() + "," + fraction
+}
+
+// csvOptions reads the delimiter and number_format parameters of CSV exports
+// and imports.
+func csvOptions(query url.Values) (delimiter rune, brl bool, err error) {
+	delimiter = ','
+	if value := query.Get("delimiter"); value != "" {
+		delimiter, _ = utf8.DecodeRuneInString(value)
+		if utf8.RuneCountInString(value) != 1 || strings.ContainsRune("\"\r\n", delimiter) {
+			return 0, false, &ValidationError{"Invalid delimiter"}
+		}
+	}
+
+	switch query.Get("number_format") {
+	case "", "plain":
+		return delimiter, false, nil
+	case "brl":
+		return delimiter, true, nil
+	default:
+		return 0, false, &ValidationError{"Invalid number format"}
+	}
+}
+
+// exportFormats are the formats exports come in, CSV being the default.
+var exportFormats = []string{"text/csv", "application/x-ndjson", "application/ndjson"}
+
+// ExportInvoicesHandler streams every invoice matching the listing filters
+// as CSV or NDJSON, with no page limit. Rows go out as they come off the
+// database cursor, so once the first one is sent a failure can only abort
+// the response.
+var ExportInvoicesHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "ExportInvoicesHandler")
+	defer span.End()
+
+	// NegotiateFormats has picked one of exportFormats
+	format := responseFormat(response)
+	if format == "application/ndjson" {
+		format = "application/x-ndjson"
+	}
+
+	delimiter, brl, err := csvOptions(request.URL.Query())
+	if err != nil {
+		RespondWithError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var encoder invoiceEncoder
+	if format == "text/csv" {
+		csv := newCSVInvoiceEncoder(response, delimiter, brl)
+		csv.header = csvHeader(ctx)
+		encoder = csv
+	} else {
+		encoder = ndjsonInvoiceEncoder{json.NewEncoder(response), ctx}
+	}
+
+	// An export easily outlasts the server write timeout; the export query
+	// timeout bounds it instead
+	controller := http.NewResponseController(response)
+	controller.SetWriteDeadline(time.Time{})
+
+	rows := 0
+	err = ExportInvoices(ctx, dbConnection, invoiceQuery(request), func(invoice Invoice) error {
+		if rows == 0 {
+			startExport(response, format)
+		}
+		rows++
+
+		if err := encoder.Encode(invoice); err != nil {
+			return err
+		}
+		if rows%exportFlushEvery == 0 {
+			if err := encoder.Flush(); err != nil {
+				return err
+			}
+			controller.Flush()
+		}
+
+		return nil
+	})
+
+	if err != nil && rows == 0 {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
+	}
+
+	if rows == 0 {
+		startExport(response, format)
+	}
+	if err == nil {
+		err = encoder.Flush()
+	}
+
+	if err != nil {
+		// The status is long gone; cut the response short so the client
+		// can't take a partial export for a complete one
+		LoggerFromContext(ctx).Error("export aborted", "rows", rows, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+})
+
+func startExport(response http.ResponseWriter, format string) {
+	extension := "csv"
+	if format != "text/csv" {
+		extension = "ndjson"
+	} else {
+		format += "; charset=utf-8"
+	}
+
+	response.Header().Set("Content-Type", format)
+	response.Header().Set("Content-Disposition", `attachment; filename="invoices.`+extension+`"`)
+	response.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFormatBRL(t *testing.T) {
+	for plain, expected := range map[string]string{
+		"0.50":        "0,50",
+		"999.21":      "999,21",
+		"1234.56":     "1.234,56",
+		"-1234567.89": "-1.234.567,89",
+		"100000":      "100.000",
+	} {
+		if formatted := formatBRL(plain); formatted != expected {
+			t.Errorf("Expected %s as %s. Got %s\n", plain, expected, formatted)
+		}
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                        "text/csv",
+		"*/*":                     "text/csv",
+		"text/*":                  "text/csv",
+		"text/csv; charset=utf-8": "text/csv",
+		"application/x-ndjson":    "application/x-ndjson",
+		"application/xml, application/ndjson;q=0.9": "application/ndjson",
+		"text/csv;q=0.1, application/x-ndjson":      "application/x-ndjson",
+		"text/csv;q=0, */*;q=0.5":                   "text/csv",
+		"text/csv;q=0, application/x-ndjson;q=0.5":  "application/x-ndjson",
+		"application/xml":                           "",
+		"text/csv;q=0":                              "",
+	} {
+		var format string
+		handler := NegotiateFormats(exportFormats...)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			format = responseFormat(response)
+		}))
+
+		request, _ := http.NewRequest("GET", "/invoices/export", nil)
+		request.Header.Set("Accept", accept)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		if format != expected {
+			t.Errorf("Expected %q for Accept %q. Got %q\n", expected, accept, format)
+		}
+		if expected == "" && response.Code != http.StatusNotAcceptable {
+			t.Errorf("Expected %d for Accept %q. Got %d\n", http.StatusNotAcceptable, accept, response.Code)
+		}
+	}
+}
+
+func TestCSVInvoiceEncoder(t *testing.T) {
+	var output bytes.Buffer
+	encoder := newCSVInvoiceEncoder(&output, ';', true)
+
+	encoder.Encode(Invoice{
+		ReferenceMonth: 9,
+		ReferenceYear:  2015,
+		Document:       "43210ABCD54321",
+		Description:    "mussum; iprem",
+		Amount:         1999.5,
+		CreatedAt:      "2015-09-05T00:00:00Z",
+		DeactiveAt:     time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC),
+	})
+	encoder.Flush()
+
+	expected := "ReferenceMonth;ReferenceYear;Document;Description;Amount;IsActive;CreatedAt;DeactiveAt\n" +
+		"9;2015;43210ABCD54321;\"mussum; iprem\";1.999,50;false;2015-09-05;2016-05-01\n"
+	if output.String() != expected {
+		t.Errorf("Expected\n%s\nGot\n%s\n", expected, output.String())
+	}
+}
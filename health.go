@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessTimeout bounds each readiness check, well under the usual probe
+// timeouts of orchestrators.
+const readinessTimeout = 2 * time.Second
+
+// expectedSchema lists the columns the queries rely on. There are no
+// versioned migrations, so readiness checks the schema itself.
+var expectedSchema = map[string][]string{
+	"invoice": {"tenant", "referencemonth", "referenceyear", "document", "description", "amount", "isactive", "createdat", "deactiveat"},
+	"apikey":  {"id", "tenant", "owner", "prefix", "keyhash", "scopes", "createdat", "revokedat"},
+}
+
+// CheckResult is the outcome of a readiness check. Why a check failed is
+// only logged: /readyz is public, and errors name hosts, users and SQL.
+type CheckResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// LivenessHandler only tells the process is up and serving; it never touches
+// dependencies, so a database outage doesn't get the process restarted.
+var LivenessHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	Respond(response, http.StatusOK, HealthReport{Status: "ok"})
+})
+
+// ReadinessHandler reports whether the service can take traffic: the
+// database answers, its schema is the one expected and auth is configured.
+func (app *App) ReadinessHandler(response http.ResponseWriter, request *http.Request) {
+	checks := map[string]func(ctx context.Context) error{
+		"database": func(ctx context.Context) error { return dbConnection.PingContext(ctx) },
+		"schema":   func(ctx context.Context) error { return checkSchema(ctx, dbConnection) },
+		"auth": func(ctx context.Context) error {
+			if app.Auth == nil || len(app.Auth.secret) == 0 {
+				return errors.New("no token key loaded")
+			}
+			return nil
+		},
+	}
+
+	report := runChecks(request.Context(), checks)
+
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	Respond(response, code, report)
+}
+
+// runChecks runs each check within readinessTimeout. Failed checks are
+// reported as unavailable, with their error logged.
+func runChecks(ctx context.Context, checks map[string]func(ctx context.Context) error) HealthReport {
+	report := HealthReport{Status: "ok", Checks: make(map[string]CheckResult)}
+
+	for name, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		start := time.Now()
+		err := check(checkCtx)
+		cancel()
+
+		result := CheckResult{Status: "ok", Latency: time.Since(start).String()}
+		if err != nil {
+			LoggerFromContext(ctx).Warn("readiness check failed", "check", name, "error", err)
+			result.Status = "unavailable"
+			report.Status = "unavailable"
+		}
+		report.Checks[name] = result
+	}
+
+	return report
+}
+
+func checkSchema(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT table_name, column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()
+		AND table_name IN ('invoice', 'apikey')`)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		found[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for table, columns := range expectedSchema {
+		for _, column := range columns {
+			if !found[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+
+	var rowSecurity, forced bool
+	err = db.QueryRowContext(ctx,
+		`SELECT relrowsecurity, relforcerowsecurity FROM pg_class WHERE oid = 'invoice'::regclass`,
+	).Scan(&rowSecurity, &forced)
+
+	if err != nil {
+		return err
+	}
+	if !rowSecurity || !forced {
+		return errors.New("row level security is not enforced on invoice")
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunChecks(t *testing.T) {
+	report := runChecks(context.Background(), map[string]func(ctx context.Context) error{
+		"database": func(ctx context.Context) error {
+			return errors.New(`dial tcp db.internal:5432: password authentication failed for user "invoices"`)
+		},
+		"auth": func(ctx context.Context) error { return nil },
+	})
+
+	if report.Status != "unavailable" || report.Checks["database"].Status != "unavailable" || report.Checks["auth"].Status != "ok" {
+		t.Errorf("Expected only the database check to be unavailable. Got %+v\n", report)
+	}
+
+	data, _ := json.Marshal(report)
+	if strings.Contains(string(data), "db.internal") || strings.Contains(string(data), "invoices") {
+		t.Errorf("Expected the report to keep the error to itself. Got %s\n", data)
+	}
+}
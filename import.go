@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportLine bounds a single NDJSON line.
+const maxImportLine = 1 << 20
+
+// importColumns are the CSV columns an import reads, named in any case and
+// with or without underscores, as in the exports of every API version.
+// Others are ignored.
+var importColumns = []string{"document", "description", "amount", "createdat"}
+
+// csvImportRows reads invoices from CSV with a header row naming the
+// columns, in any order and case. Rows are numbered by their line.
+func csvImportRows(body io.Reader, delimiter rune, brl bool) (func() (ImportRow, error), error) {
+	reader := csv.NewReader(body)
+	reader.Comma = delimiter
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, bodyError(err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[strings.ReplaceAll(name, "_", "")] = i
+	}
+	for _, name := range importColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, &ValidationError{"missing CSV column " + name}
+		}
+	}
+
+	return func() (ImportRow, error) {
+		record, err := reader.Read()
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return ImportRow{Row: parseErr.StartLine, Reason: "malformed CSV: " + parseErr.Err.Error()}, nil
+		}
+		if err != nil {
+			return ImportRow{}, bodyError(err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := ImportRow{Row: line}
+		row.Invoice.Document = record[columns["document"]]
+		row.Invoice.Description = record[columns["description"]]
+		row.Invoice.CreatedAt = record[columns["createdat"]]
+
+		amount := strings.TrimSpace(record[columns["amount"]])
+		if brl {
+			amount = strings.NewReplacer(".", "", ",", ".").Replace(amount)
+		}
+		value, err := strconv.ParseFloat(amount, 32)
+		if err != nil {
+			row.Reason = "Amount must be a number"
+		}
+		row.Invoice.Amount = float32(value)
+
+		return row, nil
+	}, nil
+}
+
+// ndjsonImportRows reads one invoice per line, skipping blank lines. Rows
+// are numbered by their line.
+func ndjsonImportRows(request *http.Request) func() (ImportRow, error) {
+	scanner := bufio.NewScanner(request.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	line := 0
+
+	return func() (ImportRow, error) {
+		for scanner.Scan() {
+			line++
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+
+			var err error
+			row := ImportRow{Row: line}
+			if row.Invoice, err = decodeInvoice(request.Context(), jsonCodec{}, strings.NewReader(scanner.Text())); err != nil {
+				row.Reason = "malformed JSON"
+			}
+
+			return row, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return ImportRow{}, bodyError(err)
+		}
+
+		return ImportRow{}, io.EOF
+	}
+}
+
+// importResponseGrace is how long past its query deadline an import still
+// has to write its response, a 504 included.
+const importResponseGrace = 10 * time.Second
+
+// extendImportDeadlines holds an import to its query timeout, which ctx
+// carries, instead of the server read and write timeouts: those suit ordinary
+// requests, not a large upload followed by a long COPY. Without a query
+// timeout the server timeouts stay, so no import holds its connection
+// forever.
+func extendImportDeadlines(ctx context.Context, response http.ResponseWriter) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	controller := http.NewResponseController(response)
+	controller.SetReadDeadline(deadline)
+	controller.SetWriteDeadline(deadline.Add(importResponseGrace))
+}
+
+// ImportInvoicesHandler creates invoices in bulk from CSV or NDJSON, as
+// told by the Content-Type, and answers with the rows accepted and those
+// rejected with why. mode=best_effort keeps the valid rows of an import that
+// has rejected ones, which otherwise is refused as a whole with a 422.
+var ImportInvoicesHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "ImportInvoicesHandler")
+	defer span.End()
+
+	extendImportDeadlines(ctx, response)
+
+	mode := request.URL.Query().Get("mode")
+	if mode != "" && mode != "atomic" && mode != "best_effort" {
+		RespondWithError(response, http.StatusBadRequest, "Invalid import mode")
+		return
+	}
+
+	delimiter, brl, err := csvOptions(request.URL.Query())
+	if err != nil {
+		RespondWithError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var next func() (ImportRow, error)
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "text/csv":
+		next, err = csvImportRows(request.Body, delimiter, brl)
+		if errors.Is(err, ErrValidation) {
+			RespondWithError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithBodyError(response, err)
+			return
+		}
+	case "application/x-ndjson", "application/ndjson":
+		next = ndjsonImportRows(request)
+	default:
+		RespondWithError(response, http.StatusUnsupportedMediaType, "Content-Type must be text/csv or application/x-ndjson")
+		return
+	}
+
+	report, err := ImportInvoices(ctx, dbConnection, tenantFromRequest(request), mode == "best_effort", next)
+	invoicesCreated.Add(float64(report.Accepted))
+
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr) && len(report.Rejected) > 0:
+		Respond(response, http.StatusUnprocessableEntity, report)
+	case err == ErrBodyTooLarge || errors.Is(err, bufio.ErrTooLong):
+		respondWithBodyError(response, ErrBodyTooLarge)
+	case err != nil:
+		respondWithStoreError(response, request, "Invoice", err)
+	default:
+		Respond(response, http.StatusOK, report)
+	}
+})
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readImportRows(t *testing.T, next func() (ImportRow, error)) []ImportRow {
+	var rows []ImportRow
+	for {
+		row, err := next()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestCSVImportRows(t *testing.T) {
+	body := "\ufeffCreatedAt;Amount;Document;Description;IsActive\n" +
+		"2015-09-05;1.234,50;43210ABCD54321;\"multi\nline\";true\n" +
+		"2015-09-06;lots;43210ABCD54322;;true\n" +
+		"2015-09-07;1,00\n"
+
+	next, err := csvImportRows(strings.NewReader(body), ';', true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	rows := readImportRows(t, next)
+
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows. Got %d\n", len(rows))
+	}
+	if row := rows[0]; row.Row != 2 || row.Reason != "" || row.Invoice.Amount != 1234.5 || row.Invoice.Description != "multi\nline" {
+		t.Errorf("Unexpected first row: %+v\n", row)
+	}
+	if row := rows[1]; row.Row != 4 || row.Reason != "Amount must be a number" {
+		t.Errorf("Unexpected second row: %+v\n", row)
+	}
+	if row := rows[2]; row.Row != 5 || !strings.HasPrefix(row.Reason, "malformed CSV") {
+		t.Errorf("Unexpected third row: %+v\n", row)
+	}
+
+	if _, err := csvImportRows(strings.NewReader("Document,Amount\n"), ',', false); !errors.Is(err, ErrValidation) {
+		t.Errorf("Expected missing columns to be rejected. Got %v\n", err)
+	}
+}
+
+func TestNDJSONImportRows(t *testing.T) {
+	body := `{"Document": "43210ABCD54321", "Amount": 10, "CreatedAt": "2015-09-05"}` + "\n\n" + `{"Document": ` + "\n"
+	request, _ := http.NewRequest("POST", "/invoices/import", strings.NewReader(body))
+
+	rows := readImportRows(t, ndjsonImportRows(request))
+
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows. Got %d\n", len(rows))
+	}
+	if row := rows[0]; row.Row != 1 || row.Reason != "" || row.Invoice.Document != "43210ABCD54321" {
+		t.Errorf("Unexpected first row: %+v\n", row)
+	}
+	if row := rows[1]; row.Row != 3 || row.Reason != "malformed JSON" {
+		t.Errorf("Unexpected second row: %+v\n", row)
+	}
+}
+
+// deadlineRecorder records the deadlines set through http.ResponseController.
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	read, write time.Time
+	set         int
+}
+
+func (recorder *deadlineRecorder) SetReadDeadline(deadline time.Time) error {
+	recorder.read = deadline
+	recorder.set++
+	return nil
+}
+
+func (recorder *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	recorder.write = deadline
+	recorder.set++
+	return nil
+}
+
+func TestImportDeadlines(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	recorder := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	extendImportDeadlines(ctx, recorder)
+
+	if !recorder.read.Equal(deadline) || !recorder.write.Equal(deadline.Add(importResponseGrace)) {
+		t.Errorf("Expected the deadlines to follow the query timeout. Got %v and %v\n", recorder.read, recorder.write)
+	}
+
+	// Without a query timeout the server deadlines stay
+	recorder = &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	extendImportDeadlines(context.Background(), recorder)
+
+	if recorder.set != 0 {
+		t.Errorf("Expected the server deadlines to stay. Got %v and %v\n", recorder.read, recorder.write)
+	}
+}
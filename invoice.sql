@@ -1,4 +1,5 @@
 CREATE TABLE Invoice (
+    Tenant VARCHAR(256) NOT NULL CHECK (Tenant <> ''),
     ReferenceMonth INTEGER,
     ReferenceYear INTEGER,
     Document VARCHAR(14),
@@ -7,4 +8,27 @@ CREATE TABLE Invoice (
     IsActive BOOLEAN,
     CreatedAt  DATE,
     DeactiveAt DATE
-);
\ No newline at end of file
+);
+
+CREATE INDEX Invoice_Tenant_Reference ON Invoice (Tenant, ReferenceYear, ReferenceMonth, Document);
+
+-- Defense in depth: every query also filters on Tenant, but the service runs
+-- each statement with app.tenant set, so a missing filter can't leak rows.
+-- FORCE makes the policy apply to the table owner as well.
+ALTER TABLE Invoice ENABLE ROW LEVEL SECURITY;
+ALTER TABLE Invoice FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY Invoice_Tenant_Isolation ON Invoice
+    USING (Tenant = current_setting('app.tenant', true))
+    WITH CHECK (Tenant = current_setting('app.tenant', true));
+
+CREATE TABLE ApiKey (
+    Id SERIAL PRIMARY KEY,
+    Tenant VARCHAR(256) NOT NULL CHECK (Tenant <> ''),
+    Owner VARCHAR(256) NOT NULL,
+    Prefix VARCHAR(16) NOT NULL,
+    KeyHash CHAR(64) NOT NULL UNIQUE,
+    Scopes TEXT[] NOT NULL DEFAULT '{}',
+    CreatedAt TIMESTAMP NOT NULL DEFAULT now(),
+    RevokedAt TIMESTAMP
+);
@@ -0,0 +1,50 @@
+-- Upgrades Invoice and ApiKey tables created before tenants, or with the
+-- empty default tenant, handing every unowned invoice and API key to an
+-- explicit tenant:
+--
+--   psql -v tenant=acme -f invoice_tenant.sql
+--
+-- Run it as the table owner, once, before starting the new service.
+BEGIN;
+
+ALTER TABLE Invoice ADD COLUMN IF NOT EXISTS Tenant VARCHAR(256);
+
+-- The policy would hide the unowned rows from the update
+ALTER TABLE Invoice NO FORCE ROW LEVEL SECURITY;
+UPDATE Invoice SET Tenant = :'tenant' WHERE Tenant IS NULL OR Tenant = '';
+
+ALTER TABLE Invoice ALTER COLUMN Tenant DROP DEFAULT;
+ALTER TABLE Invoice ALTER COLUMN Tenant SET NOT NULL;
+ALTER TABLE Invoice DROP CONSTRAINT IF EXISTS Invoice_Tenant_Check;
+ALTER TABLE Invoice ADD CONSTRAINT Invoice_Tenant_Check CHECK (Tenant <> '');
+
+CREATE INDEX IF NOT EXISTS Invoice_Tenant_Reference ON Invoice (Tenant, ReferenceYear, ReferenceMonth, Document);
+
+ALTER TABLE Invoice ENABLE ROW LEVEL SECURITY;
+ALTER TABLE Invoice FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS Invoice_Tenant_Isolation ON Invoice;
+CREATE POLICY Invoice_Tenant_Isolation ON Invoice
+    USING (Tenant = current_setting('app.tenant', true))
+    WITH CHECK (Tenant = current_setting('app.tenant', true));
+
+-- Databases from before API keys have no ApiKey table yet
+CREATE TABLE IF NOT EXISTS ApiKey (
+    Id SERIAL PRIMARY KEY,
+    Tenant VARCHAR(256) NOT NULL CHECK (Tenant <> ''),
+    Owner VARCHAR(256) NOT NULL,
+    Prefix VARCHAR(16) NOT NULL,
+    KeyHash CHAR(64) NOT NULL UNIQUE,
+    Scopes TEXT[] NOT NULL DEFAULT '{}',
+    CreatedAt TIMESTAMP NOT NULL DEFAULT now(),
+    RevokedAt TIMESTAMP
+);
+
+-- Existing keys act for the tenant their invoices went to
+ALTER TABLE ApiKey ADD COLUMN IF NOT EXISTS Tenant VARCHAR(256);
+UPDATE ApiKey SET Tenant = :'tenant' WHERE Tenant IS NULL OR Tenant = '';
+ALTER TABLE ApiKey ALTER COLUMN Tenant SET NOT NULL;
+ALTER TABLE ApiKey DROP CONSTRAINT IF EXISTS ApiKey_Tenant_Check;
+ALTER TABLE ApiKey ADD CONSTRAINT ApiKey_Tenant_Check CHECK (Tenant <> '');
+
+COMMIT;
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestInfo collects what the access log reports about a request. The
+// logging middleware puts it in the context before routing; the router and
+// AuthMiddleware fill in the rest as the request goes through them.
+type requestInfo struct {
+	ID      string
+	Route   string
+	Subject string
+	Invoice string
+	logger  *slog.Logger
+}
+
+func NewLogger(config LoggingConfig, output io.Writer) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: config.Level}
+
+	switch config.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(output, options)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(output, options)), nil
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", config.Format)
+	}
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+// LoggerFromContext returns the request scoped logger, already carrying the
+// request ID, or the default logger outside of a request.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.logger
+	}
+
+	return slog.Default()
+}
+
+// validRequestID accepts the IDs proxies and clients usually send, and
+// nothing that could forge a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// RequestLogMiddleware takes the X-Request-ID of the request, or makes one
+// up, echoes it in the response and writes one access log line per request.
+// It wraps the whole router, so it also sees requests no route matched.
+func RequestLogMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			start := time.Now()
+
+			id := request.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			response.Header().Set(requestIDHeader, id)
+
+			info := &requestInfo{ID: id, logger: logger.With("request_id", id)}
+			recorder := &statusRecorder{ResponseWriter: response}
+
+			next.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), requestInfoContextKey, info)))
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+
+			attributes := []any{
+				"method", request.Method,
+				"path", request.URL.Path,
+				"route", info.Route,
+				"status", recorder.status,
+				"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+				"remote_addr", request.RemoteAddr,
+			}
+			if info.Subject != "" {
+				attributes = append(attributes, "subject", info.Subject)
+			}
+			if info.Invoice != "" {
+				attributes = append(attributes, "invoice", info.Invoice)
+			}
+
+			info.logger.Info("request", attributes...)
+		})
+	}
+}
+
+// recordRoute notes the matched route and invoice key for the access log. It
+// is installed with Router.Use, the only place the route is known.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if info := requestInfoFromContext(request.Context()); info != nil {
+			info.Route = routeTemplate(request)
+
+			var key []string
+			vars := mux.Vars(request)
+			for _, name := range []string{"year", "month", "document"} {
+				if value, ok := vars[name]; ok {
+					key = append(key, value)
+				}
+			}
+			info.Invoice = strings.Join(key, "/")
+		}
+
+		next.ServeHTTP(response, request)
+	})
+}
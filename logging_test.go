@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestLogMiddleware(t *testing.T) {
+	var output bytes.Buffer
+	logger, _ := NewLogger(LoggingConfig{Format: "json"}, &output)
+
+	router := mux.NewRouter()
+	router.Use(recordRoute)
+	router.HandleFunc("/invoices/{year}/{month}", func(response http.ResponseWriter, request *http.Request) {
+		RespondWithError(response, http.StatusNotFound, "Invoice not found")
+	})
+	handler := RequestLogMiddleware(logger)(router)
+
+	request, _ := http.NewRequest("GET", "/invoices/2019/7", nil)
+	request.Header.Set("X-Request-ID", "trace-42")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if id := response.Header().Get("X-Request-ID"); id != "trace-42" {
+		t.Errorf("Expected the request ID to be echoed. Got %q\n", id)
+	}
+
+	var body map[string]string
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if body["request_id"] != "trace-42" {
+		t.Errorf("Expected the request ID in the error body. Got %v\n", body)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &line); err != nil {
+		t.Fatalf("Access log is not JSON: %q\n", output.String())
+	}
+	for key, expected := range map[string]interface{}{
+		"request_id": "trace-42",
+		"route":      "/invoices/{year}/{month}",
+		"invoice":    "2019/7",
+		"status":     float64(http.StatusNotFound),
+	} {
+		if line[key] != expected {
+			t.Errorf("Expected %s %v in the access log. Got %v\n", key, expected, line[key])
+		}
+	}
+
+	request.Header.Set("X-Request-ID", "forged\nline")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if id := response.Header().Get("X-Request-ID"); !validRequestID(id) || id == "forged\nline" {
+		t.Errorf("Expected a generated request ID. Got %q\n", id)
+	}
+}
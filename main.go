@@ -1,14 +1,33 @@
 package main
 
-import "os"
+import (
+	"flag"
+	"log"
+	"os"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := runTokenCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	app := App{}
-	app.Initialize(
-		os.Getenv("APP_DB_USERNAME_SANDBOX"),
-		os.Getenv("APP_DB_PASSWORD_SANDBOX"),
-		os.Getenv("APP_DB_NAME_SANDBOX"),
-	)
+	if err := app.Initialize(config); err != nil {
+		log.Fatal(err)
+	}
 
-	app.Run(":8080")
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
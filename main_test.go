@@ -2,24 +2,37 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var app App
 var apiToken string
 
+// testTenant owns every invoice the suite creates. It must match the tenant
+// of apiToken: the local issuer sets it explicitly, while Auth0 client
+// credentials tokens fall back to their subject.
+var testTenant = "main_test"
+
 func ensureTableExists(conn *sql.DB) error {
 	const tableCreationQuery = `CREATE TABLE IF NOT EXISTS invoice(
+		Tenant VARCHAR(256) NOT NULL CHECK (Tenant <> ''),
 		ReferenceMonth INTEGER,
 		ReferenceYear INTEGER,
 		Document VARCHAR(14),
@@ -30,14 +43,45 @@ func ensureTableExists(conn *sql.DB) error {
 		DeactiveAt DATE
     )`
 
-	_, err := conn.Exec(tableCreationQuery)
+	const rowLevelSecurityQuery = `
+		ALTER TABLE invoice ADD COLUMN IF NOT EXISTS Tenant VARCHAR(256) NOT NULL;
+		ALTER TABLE invoice ALTER COLUMN Tenant DROP DEFAULT;
+		ALTER TABLE invoice ENABLE ROW LEVEL SECURITY;
+		ALTER TABLE invoice FORCE ROW LEVEL SECURITY;
+		DROP POLICY IF EXISTS invoice_tenant_isolation ON invoice;
+		CREATE POLICY invoice_tenant_isolation ON invoice
+			USING (Tenant = current_setting('app.tenant', true))
+			WITH CHECK (Tenant = current_setting('app.tenant', true))`
+
+	const apiKeyTableCreationQuery = `CREATE TABLE IF NOT EXISTS apikey(
+		Id SERIAL PRIMARY KEY,
+		Tenant VARCHAR(256) NOT NULL,
+		Owner VARCHAR(256) NOT NULL,
+		Prefix VARCHAR(16) NOT NULL,
+		KeyHash CHAR(64) NOT NULL UNIQUE,
+		Scopes TEXT[] NOT NULL DEFAULT '{}',
+		CreatedAt TIMESTAMP NOT NULL DEFAULT now(),
+		RevokedAt TIMESTAMP
+    )`
+
+	if _, err := conn.Exec(tableCreationQuery); err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec(rowLevelSecurityQuery); err != nil {
+		return err
+	}
+
+	_, err := conn.Exec(apiKeyTableCreationQuery)
 	return err
 }
 
-func prepareDatabase(username, password, dbname string) error {
+func prepareDatabase(config DatabaseConfig) error {
 
-	connectionString :=
-		fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", username, password, dbname)
+	connectionString, err := config.DSN()
+	if err != nil {
+		return err
+	}
 
 	conn, err := sql.Open("postgres", connectionString)
 
@@ -50,14 +94,25 @@ func prepareDatabase(username, password, dbname string) error {
 	}
 
 	// Clear table
-	_, err = conn.Exec("DELETE FROM invoice")
-
-	// Populate table. OBS.: Worst way!
-	for i := 0; i < 404; i++ {
-		invoice := GenerateRandomInvoice()
-		err = invoice.CreateInvoice(conn)
+	err = withTenant(context.Background(), conn, testTenant, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM invoice")
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
+	// Populate table
+	rows := 0
+	_, err = ImportInvoices(context.Background(), conn, testTenant, false, func() (ImportRow, error) {
+		if rows == 404 {
+			return ImportRow{}, io.EOF
+		}
+		rows++
+
+		return ImportRow{Row: rows, Invoice: GenerateRandomInvoice()}, nil
+	})
+
 	return err
 }
 
@@ -105,6 +160,12 @@ func checkInvoiceValues(t *testing.T, invoice, correctInvoice Invoice) {
 }
 
 func getAPIKey() (string, error) {
+	// Without Auth0 credentials the suite runs offline against the local issuer
+	if os.Getenv("CLIENT_ID") == "" {
+		token, err := app.Auth.MintToken(TokenRequest{Subject: "main_test@clients", Tenant: testTenant})
+		return "Bearer " + token, err
+	}
+
 	url := os.Getenv("API_ISSUER") + "oauth/token"
 
 	payload := strings.NewReader(`{
@@ -184,13 +245,20 @@ func filterTests(t *testing.T, path string) {
 
 func TestMain(m *testing.M) {
 
-	username := os.Getenv("APP_DB_USERNAME_SANDBOX")
-	password := os.Getenv("APP_DB_PASSWORD_SANDBOX")
-	dbname := os.Getenv("APP_DB_NAME_SANDBOX")
+	if clientID := os.Getenv("CLIENT_ID"); clientID != "" {
+		testTenant = clientID + "@clients"
+	}
 
-	prepareDatabase(username, password, dbname)
+	config, err := LoadConfig(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	prepareDatabase(config.Database)
 	app = App{}
-	app.Initialize(username, password, dbname)
+	if err := app.Initialize(config); err != nil {
+		log.Fatal(err)
+	}
 	apiToken, _ = getAPIKey()
 
 	code := m.Run()
@@ -295,3 +363,455 @@ func TestDeleteInvoice(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 }
+
+func TestDeleteMissingInvoice(t *testing.T) {
+	request, _ := http.NewRequest("DELETE", "/invoices/2015/9/00000000000000", nil)
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	var body map[string]string
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if body["code"] != "not_found" || body["error"] != "Invoice not found" {
+		t.Errorf("Unexpected error body: %s\n", response.Body.String())
+	}
+}
+
+func TestExportInvoices(t *testing.T) {
+	insertInvoice(t, `{
+		"Document": "EXPORT00000001",
+		"Description": "exported",
+		"Amount": 1234.5,
+		"CreatedAt": "2014-03-10"
+	}`)
+
+	request, _ := http.NewRequest("GET", "/invoices/export?year=2014&month=3&delimiter=;&number_format=brl", nil)
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.Contains(response.Body.String(), "EXPORT00000001;exported;1.234,50;true;2014-03-10;") {
+		t.Errorf("Invoice missing from the CSV export:\n%s\n", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices/export?document=EXPORT00000001", nil)
+	request.Header.Set("Accept", "application/x-ndjson")
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if lines := strings.Count(response.Body.String(), "\n"); lines != 1 {
+		t.Errorf("Expected 1 NDJSON line. Got %d\n", lines)
+	}
+	validateInvoice(t, response.Body)
+}
+
+func TestImportInvoices(t *testing.T) {
+	body := "Document,Description,Amount,CreatedAt\n" +
+		"IMPORT00000001,imported,10.50,2013-01-02\n" +
+		"SHORT,imported,10.50,2013-01-02\n" +
+		"IMPORT00000002,imported,20.00,2013-01-03\n"
+
+	request, _ := http.NewRequest("POST", "/invoices/import", strings.NewReader(body))
+	request.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var report ImportReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if report.Accepted != 0 || len(report.Rejected) != 1 || report.Rejected[0].Row != 3 {
+		t.Errorf("Unexpected atomic import report: %s\n", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices?document=IMPORT00000001", nil)
+	response = executeRequest(request, apiToken)
+	if length := getInvoicesLength(t, response.Body.Bytes()); length != 0 {
+		t.Errorf("Expected a rejected atomic import to insert nothing. Got %d invoices\n", length)
+	}
+
+	request, _ = http.NewRequest("POST", "/invoices/import?mode=best_effort", strings.NewReader(body))
+	request.Header.Set("Content-Type", "text/csv")
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if report.Accepted != 2 || len(report.Rejected) != 1 {
+		t.Errorf("Unexpected best effort import report: %s\n", response.Body.String())
+	}
+}
+
+func batchStatuses(t *testing.T, payload string) (int, []int) {
+	request, _ := http.NewRequest("POST", "/invoices/batch", strings.NewReader(payload))
+	response := executeRequest(request, apiToken)
+
+	var body struct{ Results []BatchResult }
+	json.Unmarshal(response.Body.Bytes(), &body)
+
+	var statuses []int
+	for _, result := range body.Results {
+		statuses = append(statuses, result.Status)
+	}
+
+	return response.Code, statuses
+}
+
+func TestBatchInvoices(t *testing.T) {
+	code, statuses := batchStatuses(t, `{"operations": [
+		{"op": "create", "invoice": {"Document": "BATCH000000001", "Description": "batch", "Amount": 1, "CreatedAt": "2012-06-01"}},
+		{"op": "update", "year": 2012, "month": 6, "document": "BATCH000000001", "fields": {"Amount": 2}},
+		{"op": "delete", "year": 2012, "month": 6, "document": "BATCH000000404"}
+	]}`)
+
+	checkResponseCode(t, http.StatusOK, code)
+	if fmt.Sprint(statuses) != "[201 200 404]" {
+		t.Errorf("Unexpected batch statuses %v\n", statuses)
+	}
+
+	code, statuses = batchStatuses(t, `{"atomic": true, "operations": [
+		{"op": "create", "invoice": {"Document": "BATCH000000002", "Description": "batch", "Amount": 1, "CreatedAt": "2012-06-01"}},
+		{"op": "delete", "year": 2012, "month": 6, "document": "BATCH000000404"},
+		{"op": "delete", "year": 2012, "month": 6, "document": "BATCH000000001"}
+	]}`)
+
+	checkResponseCode(t, http.StatusUnprocessableEntity, code)
+	if fmt.Sprint(statuses) != "[424 404 424]" {
+		t.Errorf("Unexpected atomic batch statuses %v\n", statuses)
+	}
+
+	request, _ := http.NewRequest("GET", "/invoices?document=BATCH000000002", nil)
+	response := executeRequest(request, apiToken)
+	if length := getInvoicesLength(t, response.Body.Bytes()); length != 0 {
+		t.Errorf("Expected a failed atomic batch to be rolled back. Got %d invoices\n", length)
+	}
+}
+
+func TestInvoiceSummary(t *testing.T) {
+	for _, payload := range []string{
+		`{"Document": "SUMMARY0000001", "Description": "summary", "Amount": 10, "CreatedAt": "2011-02-01"}`,
+		`{"Document": "SUMMARY0000002", "Description": "summary", "Amount": 30, "CreatedAt": "2011-02-15"}`,
+	} {
+		insertInvoice(t, payload)
+	}
+
+	request, _ := http.NewRequest("GET", "/invoices/summary?group_by=year,month&year=2011&month=2", nil)
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var summaries []InvoiceSummary
+	json.Unmarshal(response.Body.Bytes(), &summaries)
+	if len(summaries) != 1 || *summaries[0].Month != 2 || summaries[0].Count < 2 || summaries[0].Max < 30 {
+		t.Errorf("Unexpected summary: %s\n", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices/summary?group_by=week", nil)
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestTimeseries(t *testing.T) {
+	insertInvoice(t, `{"Document": "SERIES00000001", "Description": "series", "Amount": 10, "CreatedAt": "2010-05-20"}`)
+
+	request, _ := http.NewRequest("GET", "/invoices/timeseries?from=2010-04&to=2010-06&document=SERIES00000001", nil)
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var buckets []TimeseriesBucket
+	json.Unmarshal(response.Body.Bytes(), &buckets)
+	if len(buckets) != 3 || buckets[0].Count != 0 || buckets[1].Count != 1 || buckets[1].Sum != 10 || buckets[2].Count != 0 {
+		t.Errorf("Unexpected series: %s\n", response.Body.String())
+	}
+
+	// Deleted invoices only count when asked for
+	insertInvoice(t, `{"Document": "SERIES00000001", "Description": "gone", "Amount": 99, "CreatedAt": "2010-06-20"}`)
+	request, _ = http.NewRequest("DELETE", "/invoices/2010/6/SERIES00000001", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(request, apiToken).Code)
+
+	for status, expected := range map[string]int64{"": 0, "&status=deleted": 1} {
+		request, _ = http.NewRequest("GET", "/invoices/timeseries?from=2010-06&to=2010-06&document=SERIES00000001"+status, nil)
+		response = executeRequest(request, apiToken)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+		json.Unmarshal(response.Body.Bytes(), &buckets)
+		if len(buckets) != 1 || buckets[0].Count != expected {
+			t.Errorf("Unexpected series for %q: %s\n", status, response.Body.String())
+		}
+	}
+
+	for _, query := range []string{"year=2010", "month=5", "status=all"} {
+		request, _ = http.NewRequest("GET", "/invoices/timeseries?from=2010-04&to=2010-06&"+query, nil)
+		checkResponseCode(t, http.StatusBadRequest, executeRequest(request, apiToken).Code)
+	}
+}
+
+func TestStatement(t *testing.T) {
+	insertInvoice(t, `{"Document": "STATEMENT00001", "Description": "first", "Amount": 10, "CreatedAt": "2011-02-10"}`)
+	insertInvoice(t, `{"Document": "STATEMENT00001", "Description": "second", "Amount": 5.5, "CreatedAt": "2012-03-10"}`)
+	insertInvoice(t, `{"Document": "STATEMENT00001", "Description": "gone", "Amount": 99, "CreatedAt": "2012-04-10"}`)
+
+	request, _ := http.NewRequest("DELETE", "/invoices/2012/4/STATEMENT00001", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(request, apiToken).Code)
+
+	request, _ = http.NewRequest("GET", "/documents/STATEMENT00001/statement?from=2011-01&to=2012-12", nil)
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var statement Statement
+	json.Unmarshal(response.Body.Bytes(), &statement)
+	if len(statement.Invoices) != 3 || statement.Total != 15.5 || statement.Deactivated != 1 || len(statement.Years) != 2 {
+		t.Errorf("Unexpected statement: %s\n", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("GET", "/documents/STATEMENT00001/statement?format=csv&to=2011-12", nil)
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], ",Balance") {
+		t.Errorf("Unexpected CSV statement: %s\n", response.Body.String())
+	}
+
+	// CSV only when it wins the negotiation, quality values included
+	for accept, csv := range map[string]bool{"text/csv": true, "application/json, text/csv;q=0.5": false, "text/csv;q=0, */*": false} {
+		request, _ = http.NewRequest("GET", "/documents/STATEMENT00001/statement?to=2011-12", nil)
+		request.Header.Set("Accept", accept)
+		response = executeRequest(request, apiToken)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if strings.HasPrefix(response.Header().Get("Content-Type"), "text/csv") != csv {
+			t.Errorf("Unexpected %s statement for %q\n", response.Header().Get("Content-Type"), accept)
+		}
+	}
+}
+
+func TestInvoicePDF(t *testing.T) {
+	insertInvoice(t, `{"Document": "PRINTABLE00001", "Description": "printed", "Amount": 42, "CreatedAt": "2012-06-10"}`)
+
+	request, _ := http.NewRequest("GET", "/invoices/2012/6/PRINTABLE00001", nil)
+	request.Header.Set("Accept", "application/pdf")
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Content-Type") != "application/pdf" || !strings.HasPrefix(response.Body.String(), "%PDF-") {
+		t.Errorf("Expected a PDF. Got %s\n", response.Header().Get("Content-Type"))
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices/2012/6/PRINTABLE00002", nil)
+	request.Header.Set("Accept", "application/pdf")
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestContentNegotiation(t *testing.T) {
+	payload := `<Invoice><Document>NEGOTIATED0001</Document><Description>xml</Description><Amount>7.5</Amount><CreatedAt>2013-03-03</CreatedAt></Invoice>`
+
+	request, _ := http.NewRequest("POST", "/invoice", strings.NewReader(payload))
+	request.Header.Set("Content-Type", "application/xml")
+	request.Header.Set("Accept", "application/xml")
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	if response.Header().Get("Content-Type") != "application/xml" || !strings.Contains(response.Body.String(), "<Document>NEGOTIATED0001</Document>") {
+		t.Errorf("Expected the invoice as XML. Got %s\n", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("PUT", "/invoices/2013/3/NEGOTIATED0001", strings.NewReader(`<Invoice><Amount>8</Amount></Invoice>`))
+	request.Header.Set("Content-Type", "application/xml")
+	checkResponseCode(t, http.StatusOK, executeRequest(request, apiToken).Code)
+
+	request, _ = http.NewRequest("GET", "/invoices?document=NEGOTIATED0001", nil)
+	request.Header.Set("Accept", "application/msgpack")
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var invoices []Invoice
+	if err := (msgpackCodec{}).Decode(context.Background(), response.Body, &invoices); err != nil || len(invoices) != 1 || invoices[0].Amount != 8 {
+		t.Errorf("Unexpected MessagePack listing %v: %v\n", invoices, err)
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices", nil)
+	request.Header.Set("Accept", "image/png")
+	checkResponseCode(t, http.StatusNotAcceptable, executeRequest(request, apiToken).Code)
+}
+
+func TestVersionedAPI(t *testing.T) {
+	payload := `{"document": "VERSIONED00001", "description": "v1", "amount": 3.25, "created_at": "2014-02-03T12:00:00Z"}`
+
+	request, _ := http.NewRequest("POST", "/v1/invoice", strings.NewReader(payload))
+	response := executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	if response.Header().Get("Deprecation") != "" {
+		t.Error("Expected /v1 not to be deprecated")
+	}
+
+	var invoice InvoiceV1
+	json.Unmarshal(response.Body.Bytes(), &invoice)
+	if invoice.Document != "VERSIONED00001" || invoice.ReferenceMonth != 2 || invoice.Amount != 3.25 || invoice.DeactivatedAt != nil {
+		t.Errorf("Unexpected invoice %s\n", response.Body.String())
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices/2014/2/VERSIONED00001", nil)
+	response = executeRequest(request, apiToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Deprecation") == "" || response.Header().Get("Sunset") == "" || !strings.Contains(response.Body.String(), `"ReferenceMonth":2`) {
+		t.Errorf("Expected a deprecated legacy response. Got %v %s\n", response.Header(), response.Body.String())
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	key := APIKey{Tenant: testTenant, Owner: "batch-job", Scopes: []string{"invoices:read"}}
+	plain, err := key.CreateAPIKey(context.Background(), dbConnection)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	response := executeRequest(request, "ApiKey "+plain)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	request, _ = http.NewRequest("GET", "/invoices", nil)
+	request.Header.Set("X-API-Key", plain)
+	response = httptest.NewRecorder()
+	app.Router.ServeHTTP(response, request)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	request, _ = http.NewRequest("GET", "/apikeys", nil)
+	response = executeRequest(request, "ApiKey "+plain)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	if _, err := RevokeAPIKey(context.Background(), dbConnection, testTenant, key.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ = http.NewRequest("GET", "/invoices", nil)
+	response = executeRequest(request, "ApiKey "+plain)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestExpiredToken(t *testing.T) {
+	token, err := app.Auth.MintToken(TokenRequest{Subject: "main_test@clients", TTL: -time.Hour})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	response := executeRequest(request, "Bearer "+token)
+
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestForeignToken(t *testing.T) {
+	foreign, _ := NewAuthenticator(AuthConfig{Secret: "not the API secret", Issuer: "https://elsewhere/", Audience: "https://elsewhere/", TenantClaim: DefaultTenantClaim})
+	token, err := foreign.MintToken(TokenRequest{Subject: "main_test@clients"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	response := executeRequest(request, "Bearer "+token)
+
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	insertInvoice(t, `{
+		"Document": "TENANT00000001",
+		"Description": "Only for main_test",
+		"Amount": 10.00,
+		"CreatedAt": "2014-03-02"
+	}`)
+
+	token, err := app.Auth.MintToken(TokenRequest{Subject: "intruder@clients", Tenant: "another_tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := http.NewRequest("GET", "/invoices/2014/3/TENANT00000001", nil)
+	response := executeRequest(request, "Bearer "+token)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if length := getInvoicesLength(t, body); length != 0 {
+		t.Errorf("Another tenant could read %d invoices\n", length)
+	}
+
+	var count int
+	err = withTenant(context.Background(), dbConnection, "another_tenant", func(tx *sql.Tx) error {
+		return tx.QueryRow("SELECT count(*) FROM invoice").Scan(&count)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Row level security let another tenant see %d invoices\n", count)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	for _, path := range []string{"/healthz", "/readyz"} {
+		request, _ := http.NewRequest("GET", path, nil)
+		response := httptest.NewRecorder()
+		app.Router.ServeHTTP(response, request)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var report HealthReport
+		if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil || report.Status != "ok" {
+			t.Errorf("%s is not healthy: %s\n", path, response.Body.String())
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/invoices/2013", nil)
+	executeRequest(request, apiToken)
+
+	request, _ = http.NewRequest("GET", "/metrics", nil)
+	response := httptest.NewRecorder()
+	app.Router.ServeHTTP(response, request)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	body := response.Body.String()
+	for _, metric := range []string{
+		`http_requests_total{method="GET",route="/invoices/{year:19[5-9][0-9]|20[0-9]{2}}",status="200"}`,
+		`db_query_duration_seconds_count{operation="get"}`,
+		"go_sql_open_connections",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Metric %s not exported\n", metric)
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	setupTracing(TracingConfig{Exporter: "none"})
+
+	request, _ := http.NewRequest("GET", "/invoices/2013", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	executeRequest(request, apiToken)
+
+	names := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Span %s did not join the incoming trace\n", span.Name())
+		}
+		names[span.Name()] = true
+	}
+
+	for _, name := range []string{"GET /invoices/{year:19[5-9][0-9]|20[0-9]{2}}", "AuthMiddleware", "GetInvoicesHandler", "GetInvoices", "createSelectStatement", "SELECT"} {
+		if !names[name] {
+			t.Errorf("No %s span was recorded\n", name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route template and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route template and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Rejected requests by reason.",
+	}, []string{"reason"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Invoice store latency by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	invoicesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "invoices_created_total",
+		Help: "Invoices created.",
+	})
+
+	invoicesDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "invoices_deleted_total",
+		Help: "Invoices soft-deleted.",
+	})
+)
+
+// registerDBStats exports the pool statistics of db. Registering the same
+// pool twice, as tests re-initializing the App do, is not an error.
+func registerDBStats(db *sql.DB) error {
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, "invoices"))
+
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		return nil
+	}
+
+	return err
+}
+
+// observeQuery records the latency of a store operation started at start;
+// call it deferred.
+func observeQuery(operation string, start time.Time) {
+	dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// authFailureReason buckets authentication errors into a few stable labels.
+func authFailureReason(err error) string {
+	switch {
+	case err == ErrTokenNotFound:
+		return "missing_credentials"
+	case err == ErrInvalidAPIKey:
+		return "invalid_api_key"
+	case err == ErrMissingScope:
+		return "insufficient_scope"
+	case err == ErrMissingTenant:
+		return "missing_tenant"
+	case err == jwt.ErrExpired:
+		return "expired"
+	case err == jwt.ErrInvalidIssuer, err == jwt.ErrInvalidAudience, err == jwt.ErrNotValidYet:
+		return "invalid_claims"
+	case err == ErrInvalidAlgorithm, err == jose.ErrCryptoFailure:
+		return "invalid_signature"
+	default:
+		return "invalid_token"
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(code int) {
+	recorder.status = code
+	recorder.ResponseWriter.WriteHeader(code)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// routeTemplate is the path template of the matched route, keeping label
+// cardinality bounded whatever the actual year/month/document.
+func routeTemplate(request *http.Request) string {
+	if route := mux.CurrentRoute(request); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return "unmatched"
+}
+
+// MetricsMiddleware counts and times requests. It is installed with
+// Router.Use, so it runs after routing and sees the route template.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: response}
+
+		next.ServeHTTP(recorder, request)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		labels := prometheus.Labels{
+			"method": request.Method,
+			"route":  routeTemplate(request),
+			"status": strconv.Itoa(recorder.status),
+		}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"io"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// invoiceColumns lists the columns scanned into an Invoice, in Scan order.
+const invoiceColumns = "ReferenceMonth, ReferenceYear, Document, Description, Amount, IsActive, CreatedAt, DeactiveAt"
+
 type Invoice struct {
+	// Tenant owns the invoice; it comes from the caller's credentials, never
+	// from the payload
+	Tenant         string `json:"-" xml:"-"`
 	ReferenceMonth int
 	ReferenceYear  int
 	Document       string  `json:"Document"`
@@ -18,71 +29,203 @@ type Invoice struct {
 	DeactiveAt     interface{}
 }
 
+// Validate checks an invoice about to be created.
+func (invoice *Invoice) Validate() error {
+	createdAt, err := time.Parse("2006-01-02", invoice.CreatedAt)
+
+	switch {
+	case err != nil:
+		return &ValidationError{"CreatedAt must be a YYYY-MM-DD date"}
+	case createdAt.After(time.Now()):
+		return &ValidationError{"CreatedAt must not be in the future"}
+	case len(invoice.Document) != 14:
+		return &ValidationError{"Document must have 14 characters"}
+	case len(invoice.Description) > 256:
+		return &ValidationError{"Description must have at most 256 characters"}
+	}
+
+	return nil
+}
+
+// validateUpdate checks the fields of an update, of which only Document,
+// Description, Amount and CreatedAt can be changed.
+func validateUpdate(fields map[string]interface{}) error {
+	updatable := 0
+
+	for k, v := range fields {
+		text, isText := v.(string)
+
+		switch strings.ToLower(k) {
+		case "document":
+			if !isText || len(text) != 14 {
+				return &ValidationError{"Document must have 14 characters"}
+			}
+		case "description":
+			if !isText || len(text) > 256 {
+				return &ValidationError{"Description must have at most 256 characters"}
+			}
+		case "amount":
+			_, isNumber := v.(float64)
+			if isText {
+				// XML has only text, numbers included
+				_, err := strconv.ParseFloat(text, 64)
+				isNumber = err == nil
+			}
+			if !isNumber {
+				return &ValidationError{"Amount must be a number"}
+			}
+		case "createdat":
+			if !isText {
+				return &ValidationError{"CreatedAt must be a YYYY-MM-DD date"}
+			}
+			if err := (&Invoice{CreatedAt: text, Document: "00000000000000"}).Validate(); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		updatable++
+	}
+
+	if updatable == 0 {
+		return &ValidationError{"nothing to update"}
+	}
+
+	return nil
+}
+
+// setReference fills in what a new invoice derives from its CreatedAt date.
+func (invoice *Invoice) setReference() {
+	month, _ := strconv.Atoi(invoice.CreatedAt[5:7])
+	year, _ := strconv.Atoi(invoice.CreatedAt[:4])
+
+	invoice.ReferenceMonth = month
+	invoice.ReferenceYear = year
+	invoice.IsActive = true
+	invoice.DeactiveAt = nil
+}
+
 func createSelectStatement(sqlParams map[string]interface{}) (string, []interface{}) {
 
-	sqlStatement := "SELECT * FROM invoice "
-	params := make([]interface{}, 0)
-	counter := 1
+	where, params := createWhereClause(sqlParams)
+	sqlStatement := "SELECT " + invoiceColumns + " FROM invoice " + where
+	counter := len(params) + 1
+
+	// Order by month, year, document or all of these;
+	if iOrderby, ok := sqlParams["orderby"]; ok {
+		sqlStatement += "ORDER BY "
+		orderby := iOrderby.([]string)
+
+		for _, ob := range orderby {
+			switch ob {
+			case "year":
+				sqlStatement += "ReferenceYear, "
+			case "month":
+				sqlStatement += "ReferenceMonth, "
+			case "document":
+				sqlStatement += "Document, "
+			}
+		}
+
+		sqlStatement = sqlStatement[:len(sqlStatement)-2] + " "
+	}
+
+	// Pagination; exports go without it
+	if limit, ok := sqlParams["limit"]; ok {
+		sqlStatement += "LIMIT $" + strconv.Itoa(counter) + " OFFSET $" + strconv.Itoa(counter+1)
+		params = append(params, limit.(int), sqlParams["offset"].(int))
+	}
+
+	return strings.TrimSpace(sqlStatement), params
+}
+
+// createWhereClause filters on the tenant, and the month, year, document and
+// status of the listing parameters. Placeholders are numbered from $1.
+func createWhereClause(sqlParams map[string]interface{}) (string, []interface{}) {
+
+	sqlStatement := "WHERE Tenant = $1 "
+	params := []interface{}{sqlParams["tenant"]}
+	counter := 2
 
 	// Filter: month, year, document
 	if iWhere, ok := sqlParams["where"]; ok {
 		where := iWhere.(map[string]string)
-		sqlStatement += "WHERE "
 
 		month, ok := where["month"]
 		if ok {
-			sqlStatement += "ReferenceMonth = $" + strconv.Itoa(counter) + " AND "
+			sqlStatement += "AND ReferenceMonth = $" + strconv.Itoa(counter) + " "
 			params = append(params, month)
 			counter++
 		}
 
 		year, ok := where["year"]
 		if ok {
-			sqlStatement += "ReferenceYear = $" + strconv.Itoa(counter) + " AND "
+			sqlStatement += "AND ReferenceYear = $" + strconv.Itoa(counter) + " "
 			params = append(params, year)
 			counter++
 		}
 
 		document, ok := where["document"]
 		if ok {
-			sqlStatement += "Document = $" + strconv.Itoa(counter) + " AND "
+			sqlStatement += "AND Document = $" + strconv.Itoa(counter) + " "
 			params = append(params, document)
 			counter++
 		}
+	}
 
-		sqlStatement = sqlStatement[:len(sqlStatement)-4]
+	// Filter: reference periods, counted in months since year 0
+	if period, ok := sqlParams["period"]; ok {
+		bounds := period.([2]int)
+		sqlStatement += "AND ReferenceYear * 12 + ReferenceMonth - 1 BETWEEN $" + strconv.Itoa(counter) + " AND $" + strconv.Itoa(counter+1) + " "
+		params = append(params, bounds[0], bounds[1])
+		counter += 2
 	}
 
-	// Order by month, year, document or all of these;
-	if iOrderby, ok := sqlParams["orderby"]; ok {
-		sqlStatement += "ORDER BY "
-		orderby := iOrderby.([]string)
+	// Filter: active or deleted only
+	switch sqlParams["status"] {
+	case "active":
+		sqlStatement += "AND IsActive "
+	case "deleted":
+		sqlStatement += "AND NOT IsActive "
+	}
 
-		for _, ob := range orderby {
-			switch ob {
-			case "year":
-				sqlStatement += "ReferenceYear, "
-			case "month":
-				sqlStatement += "ReferenceMonth, "
-			case "document":
-				sqlStatement += "Document, "
-			}
+	return sqlStatement, params
+}
+
+// createSummaryStatement totals the invoices matching sqlParams per group of
+// groupBy, a list of year, month and document.
+func createSummaryStatement(sqlParams map[string]interface{}, groupBy []string) (string, []interface{}) {
+
+	var columns []string
+	for _, group := range groupBy {
+		switch group {
+		case "year":
+			columns = append(columns, "ReferenceYear")
+		case "month":
+			columns = append(columns, "ReferenceMonth")
+		case "document":
+			columns = append(columns, "Document")
 		}
+	}
 
-		sqlStatement = sqlStatement[:len(sqlStatement)-2] + " "
+	sqlStatement := "SELECT "
+	for _, column := range columns {
+		sqlStatement += column + ", "
 	}
+	sqlStatement += "COUNT(*), COALESCE(SUM(Amount), 0), COALESCE(ROUND(AVG(Amount), 2), 0), COALESCE(MIN(Amount), 0), COALESCE(MAX(Amount), 0) FROM invoice "
 
-	// Pagination
-	limit := sqlParams["limit"].(int)
-	offset := sqlParams["offset"].(int)
+	where, params := createWhereClause(sqlParams)
+	sqlStatement += where
 
-	sqlStatement += "LIMIT $" + strconv.Itoa(counter) + " OFFSET $" + strconv.Itoa(counter+1)
-	params = append(params, limit, offset)
+	if len(columns) > 0 {
+		sqlStatement += "GROUP BY " + strings.Join(columns, ", ") + " ORDER BY " + strings.Join(columns, ", ")
+	}
 
-	return sqlStatement, params
+	return strings.TrimSpace(sqlStatement), params
 }
 
-func createUpdateStatement(sqlParams map[string]interface{}, month, year int, document string) (string, []interface{}) {
+func createUpdateStatement(sqlParams map[string]interface{}, month, year int, document, tenant string) (string, []interface{}) {
 	var params []interface{}
 	var counter int
 	sqlStatement := "UPDATE invoice SET "
@@ -94,6 +237,7 @@ func createUpdateStatement(sqlParams map[string]interface{}, month, year int, do
 		switch k {
 		case "document":
 			sqlStatement += "document=$" + strconv.Itoa(counter) + ", "
+			params = append(params, v)
 		case "description":
 			sqlStatement += "description=$" + strconv.Itoa(counter) + ", "
 			params = append(params, v)
@@ -118,25 +262,31 @@ func createUpdateStatement(sqlParams map[string]interface{}, month, year int, do
 	sqlStatement = sqlStatement[:len(sqlStatement)-2] + " WHERE "
 	sqlStatement += "ReferenceMonth = $" + strconv.Itoa(counter+1) + " AND "
 	sqlStatement += "ReferenceYear = $" + strconv.Itoa(counter+2) + " AND "
-	sqlStatement += "Document = $" + strconv.Itoa(counter+3)
+	sqlStatement += "Document = $" + strconv.Itoa(counter+3) + " AND "
+	sqlStatement += "Tenant = $" + strconv.Itoa(counter+4)
 
-	params = append(params, month, year, document)
+	params = append(params, month, year, document, tenant)
 
 	return sqlStatement, params
 }
 
-func (invoice *Invoice) CreateInvoice(db *sql.DB) error {
-	month, _ := strconv.Atoi(invoice.CreatedAt[5:7])
-	year, _ := strconv.Atoi(invoice.CreatedAt[:4])
+func (invoice *Invoice) CreateInvoice(ctx context.Context, db *sql.DB) (err error) {
+	defer observeQuery("create", time.Now())
+	ctx, span := tracer.Start(ctx, "CreateInvoice")
+	defer func() { endSpan(span, err) }()
 
-	invoice.ReferenceMonth = month
-	invoice.ReferenceYear = year
-	invoice.IsActive = true
-	invoice.DeactiveAt = nil
+	return withTenant(ctx, db, invoice.Tenant, func(tx *sql.Tx) error {
+		return invoice.insert(ctx, tx)
+	})
+}
+
+func (invoice *Invoice) insert(ctx context.Context, q queryer) error {
+	invoice.setReference()
 
-	_, err := db.Exec(
-		`INSERT INTO invoice(ReferenceMonth, ReferenceYear, Document, Description, Amount, IsActive, CreatedAt, DeactiveAt)
-		 VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+	_, err := execTraced(ctx, q,
+		`INSERT INTO invoice(Tenant, ReferenceMonth, ReferenceYear, Document, Description, Amount, IsActive, CreatedAt, DeactiveAt)
+		 VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		invoice.Tenant,
 		invoice.ReferenceMonth,
 		invoice.ReferenceYear,
 		invoice.Document,
@@ -150,61 +300,424 @@ func (invoice *Invoice) CreateInvoice(db *sql.DB) error {
 	return err
 }
 
-func GetInvoices(db *sql.DB, params map[string]interface{}) ([]Invoice, error) {
-	sqlStatement, sqlParams := createSelectStatement(params)
-	rows, err := db.Query(sqlStatement, sqlParams...)
+func GetInvoices(ctx context.Context, db *sql.DB, params map[string]interface{}) (invoices []Invoice, err error) {
+	defer observeQuery("get", time.Now())
+	ctx, span := tracer.Start(ctx, "GetInvoices")
+	defer func() { endSpan(span, err) }()
+
+	invoices = []Invoice{}
+
+	err = forEachInvoice(ctx, db, params, func(invoice Invoice) error {
+		invoices = append(invoices, invoice)
+		return nil
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer rows.Close()
+	return invoices, nil
+}
+
+// ExportInvoices calls fn with each invoice matching params as it is read
+// from the database cursor, so the result set never has to fit in memory.
+// It stops at the first error fn returns.
+func ExportInvoices(ctx context.Context, db *sql.DB, params map[string]interface{}, fn func(Invoice) error) (err error) {
+	defer observeQuery("export", time.Now())
+	ctx, span := tracer.Start(ctx, "ExportInvoices")
+	defer func() { endSpan(span, err) }()
 
-	invoices := []Invoice{}
+	return forEachInvoice(ctx, db, params, fn)
+}
 
-	for rows.Next() {
-		var invoice Invoice
-		err := rows.Scan(
-			&invoice.ReferenceMonth,
-			&invoice.ReferenceYear,
-			&invoice.Document,
-			&invoice.Description,
-			&invoice.Amount,
-			&invoice.IsActive,
-			&invoice.CreatedAt,
-			&invoice.DeactiveAt,
-		)
+// InvoiceSummary totals the Amount of a group of invoices. Only the fields
+// grouped by are set.
+type InvoiceSummary struct {
+	Year     *int    `json:"year,omitempty"`
+	Month    *int    `json:"month,omitempty"`
+	Document *string `json:"document,omitempty"`
+	Count    int64   `json:"count"`
+	Sum      float64 `json:"sum"`
+	Average  float64 `json:"average"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+}
+
+// SummarizeInvoices aggregates the invoices matching params in SQL, per
+// group of groupBy, a list of year, month and document. Without groups it
+// returns a single summary of everything.
+func SummarizeInvoices(ctx context.Context, db *sql.DB, params map[string]interface{}, groupBy []string) (summaries []InvoiceSummary, err error) {
+	defer observeQuery("summary", time.Now())
+	ctx, span := tracer.Start(ctx, "SummarizeInvoices")
+	defer func() { endSpan(span, err) }()
+
+	sqlStatement, sqlParams := createSummaryStatement(params, groupBy)
+	summaries = []InvoiceSummary{}
+
+	err = withTenant(ctx, db, params["tenant"].(string), func(tx *sql.Tx) error {
+		rows, err := queryTraced(ctx, tx, sqlStatement, sqlParams...)
 
 		if err != nil {
-			return nil, err
+			return err
 		}
-		invoices = append(invoices, invoice)
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var summary InvoiceSummary
+
+			var dest []interface{}
+			for _, group := range groupBy {
+				switch group {
+				case "year":
+					summary.Year = new(int)
+					dest = append(dest, summary.Year)
+				case "month":
+					summary.Month = new(int)
+					dest = append(dest, summary.Month)
+				case "document":
+					summary.Document = new(string)
+					dest = append(dest, summary.Document)
+				}
+			}
+			dest = append(dest, &summary.Count, &summary.Sum, &summary.Average, &summary.Min, &summary.Max)
+
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			summaries = append(summaries, summary)
+		}
+
+		return rows.Err()
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return invoices, nil
+	return summaries, nil
 }
 
-func (invoice *Invoice) UpdateInvoice(db *sql.DB, month, year int, document string, toUpdate map[string]interface{}) error {
-	sqlStatement, params := createUpdateStatement(toUpdate, month, year, document)
-	_, err := db.Exec(sqlStatement, params...)
+func forEachInvoice(ctx context.Context, db *sql.DB, params map[string]interface{}, fn func(Invoice) error) error {
+	_, statementSpan := tracer.Start(ctx, "createSelectStatement")
+	sqlStatement, sqlParams := createSelectStatement(params)
+	statementSpan.End()
 
-	return err
+	return withTenant(ctx, db, params["tenant"].(string), func(tx *sql.Tx) error {
+		rows, err := queryTraced(ctx, tx, sqlStatement, sqlParams...)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var invoice Invoice
+			err := rows.Scan(
+				&invoice.ReferenceMonth,
+				&invoice.ReferenceYear,
+				&invoice.Document,
+				&invoice.Description,
+				&invoice.Amount,
+				&invoice.IsActive,
+				&invoice.CreatedAt,
+				&invoice.DeactiveAt,
+			)
+
+			if err != nil {
+				return err
+			}
+			if err := fn(invoice); err != nil {
+				return err
+			}
+		}
+
+		return rows.Err()
+	})
+}
+
+func (invoice *Invoice) UpdateInvoice(ctx context.Context, db *sql.DB, month, year int, document string, toUpdate map[string]interface{}) (err error) {
+	defer observeQuery("update", time.Now())
+	ctx, span := tracer.Start(ctx, "UpdateInvoice")
+	defer func() { endSpan(span, err) }()
+
+	return withTenant(ctx, db, invoice.Tenant, func(tx *sql.Tx) error {
+		return invoice.update(ctx, tx, month, year, document, toUpdate)
+	})
+}
+
+func (invoice *Invoice) update(ctx context.Context, q queryer, month, year int, document string, toUpdate map[string]interface{}) error {
+	sqlStatement, params := createUpdateStatement(toUpdate, month, year, document, invoice.Tenant)
+
+	result, err := execTraced(ctx, q, sqlStatement, params...)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
 }
 
-func (invoice *Invoice) DeleteInvoice(db *sql.DB) error {
+func (invoice *Invoice) DeleteInvoice(ctx context.Context, db *sql.DB) (err error) {
+	defer observeQuery("delete", time.Now())
+	ctx, span := tracer.Start(ctx, "DeleteInvoice")
+	defer func() { endSpan(span, err) }()
+
+	return withTenant(ctx, db, invoice.Tenant, func(tx *sql.Tx) error {
+		return invoice.softDelete(ctx, tx)
+	})
+}
+
+func (invoice *Invoice) softDelete(ctx context.Context, q queryer) error {
 	today := time.Now().Format("2006-01-02")
-	_, err := db.Exec(`
+
+	result, err := execTraced(ctx, q, `
 		UPDATE invoice
-		SET isActive = false
-		AND DeactiveAt = $1
+		SET isActive = false,
+		DeactiveAt = $1
 		WHERE ReferenceMonth = $2
 		AND ReferenceYear = $3
-		AND Document = $4`,
+		AND Document = $4
+		AND Tenant = $5`,
 		today,
 		invoice.ReferenceMonth,
 		invoice.ReferenceYear,
 		invoice.Document,
+		invoice.Tenant,
 	)
 
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
+}
+
+// importBatchSize is how many rows go to Postgres in each COPY.
+const importBatchSize = 1000
+
+// ImportRow is one row of a bulk import, numbered as in the source file. A
+// row that failed to parse has its Reason set instead of an Invoice.
+type ImportRow struct {
+	Row     int
+	Invoice Invoice
+	Reason  string
+}
+
+type RejectedRow struct {
+	Row    int    `json:"row"`
+	Reason string `json:"reason"`
+}
+
+type ImportReport struct {
+	Accepted int           `json:"accepted"`
+	Rejected []RejectedRow `json:"rejected"`
+}
+
+// ImportInvoices creates the invoices next yields, until it returns io.EOF,
+// for tenant. Rows are validated like single invoices and inserted with
+// COPY in batches, all in one transaction.
+//
+// Unless bestEffort is set, the import is all-or-nothing: a single rejected
+// row rolls it all back, and the error is an ErrValidation with the report
+// listing the rejections. In best effort mode rejected rows are reported and
+// skipped, including those the database refuses.
+func ImportInvoices(ctx context.Context, db *sql.DB, tenant string, bestEffort bool, next func() (ImportRow, error)) (report ImportReport, err error) {
+	defer observeQuery("import", time.Now())
+	ctx, span := tracer.Start(ctx, "ImportInvoices")
+	defer func() { endSpan(span, err) }()
+
+	report.Rejected = []RejectedRow{}
+
+	err = withTenant(ctx, db, tenant, func(tx *sql.Tx) error {
+		// COPY can't write to a table with row level security, so rows are
+		// staged in a temporary table and moved over with INSERT, which the
+		// policy checks
+		if _, err := execTraced(ctx, tx, "CREATE TEMPORARY TABLE invoice_import (LIKE invoice INCLUDING DEFAULTS) ON COMMIT DROP"); err != nil {
+			return err
+		}
+
+		var batch []ImportRow
+		for {
+			row, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if row.Reason == "" {
+				if err := row.Invoice.Validate(); err != nil {
+					row.Reason = err.Error()
+				}
+			}
+			if row.Reason != "" {
+				report.Rejected = append(report.Rejected, RejectedRow{row.Row, row.Reason})
+				continue
+			}
+
+			row.Invoice.Tenant = tenant
+			row.Invoice.setReference()
+			batch = append(batch, row)
+
+			if len(batch) == importBatchSize {
+				if err := importBatch(ctx, tx, batch, bestEffort, &report); err != nil {
+					return err
+				}
+				batch = batch[:0]
+			}
+		}
+
+		if err := importBatch(ctx, tx, batch, bestEffort, &report); err != nil {
+			return err
+		}
+
+		if !bestEffort && len(report.Rejected) > 0 {
+			return &ValidationError{"import rejected"}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		report.Accepted = 0
+	}
+
+	return report, err
+}
+
+// importBatch inserts batch. In best effort mode a batch the database
+// refuses is retried row by row, each in its own savepoint, to find and skip
+// the culprits.
+func importBatch(ctx context.Context, tx *sql.Tx, batch []ImportRow, bestEffort bool, report *ImportReport) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if !bestEffort {
+		if err := copyInvoices(ctx, tx, batch); err != nil {
+			return err
+		}
+		report.Accepted += len(batch)
+		return nil
+	}
+
+	err := inSavepoint(ctx, tx, func() error { return copyInvoices(ctx, tx, batch) })
+	if err == nil {
+		report.Accepted += len(batch)
+		return nil
+	}
+	if errors.Is(classifyError(err), ErrUnavailable) {
+		return err
+	}
+
+	for _, row := range batch {
+		err := inSavepoint(ctx, tx, func() error { return copyInvoices(ctx, tx, []ImportRow{row}) })
+		if err == nil {
+			report.Accepted++
+			continue
+		}
+		if !errors.Is(classifyError(err), ErrValidation) {
+			return err
+		}
+
+		LoggerFromContext(ctx).Info("import row rejected", "row", row.Row, "error", err)
+		report.Rejected = append(report.Rejected, RejectedRow{row.Row, "rejected by the database"})
+	}
+
+	return nil
+}
+
+func copyInvoices(ctx context.Context, tx *sql.Tx, rows []ImportRow) (err error) {
+	statement := pq.CopyIn("invoice_import", "tenant", "referencemonth", "referenceyear", "document", "description", "amount", "isactive", "createdat", "deactiveat")
+	ctx, span := startQuerySpan(ctx, statement)
+	defer func() { endSpan(span, err) }()
+
+	stmt, err := tx.PrepareContext(ctx, statement)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		invoice := row.Invoice
+		_, err := stmt.ExecContext(ctx,
+			invoice.Tenant,
+			invoice.ReferenceMonth,
+			invoice.ReferenceYear,
+			invoice.Document,
+			invoice.Description,
+			invoice.Amount,
+			invoice.IsActive,
+			invoice.CreatedAt,
+			invoice.DeactiveAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+
+	if _, err := execTraced(ctx, tx, "INSERT INTO invoice SELECT * FROM invoice_import"); err != nil {
+		return err
+	}
+
+	_, err = execTraced(ctx, tx, "TRUNCATE invoice_import")
+	return err
+}
+
+// inSavepoint runs fn so that if it fails, the transaction is rolled back
+// to where it was before and can carry on.
+func inSavepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	if _, err := execTraced(ctx, tx, "SAVEPOINT step"); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		if _, rollbackErr := execTraced(ctx, tx, "ROLLBACK TO SAVEPOINT step"); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	_, err := execTraced(ctx, tx, "RELEASE SAVEPOINT step")
 	return err
 }
+
+// expectAffected reports ErrNotFound when a statement changed no row.
+func expectAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// withTenant runs fn in a transaction where app.tenant is set to tenant. The
+// row level security policy on invoice checks that setting, so a query that
+// forgets its Tenant filter still can't reach other tenants' rows.
+func withTenant(ctx context.Context, db *sql.DB, tenant string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := execTraced(ctx, tx, "SELECT set_config('app.tenant', $1, true)", tenant); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCreateSummaryStatement(t *testing.T) {
+	statement, params := createSummaryStatement(map[string]interface{}{
+		"tenant": "acme",
+		"where":  map[string]string{"year": "2019"},
+		"status": "active",
+	}, []string{"month", "document"})
+
+	expected := "SELECT ReferenceMonth, Document, COUNT(*), COALESCE(SUM(Amount), 0), COALESCE(ROUND(AVG(Amount), 2), 0), COALESCE(MIN(Amount), 0), COALESCE(MAX(Amount), 0) " +
+		"FROM invoice WHERE Tenant = $1 AND ReferenceYear = $2 AND IsActive GROUP BY ReferenceMonth, Document ORDER BY ReferenceMonth, Document"
+	if statement != expected {
+		t.Errorf("Expected\n%s\nGot\n%s\n", expected, statement)
+	}
+	if fmt.Sprint(params) != "[acme 2019]" {
+		t.Errorf("Unexpected params %v\n", params)
+	}
+
+	statement, _ = createSummaryStatement(map[string]interface{}{"tenant": "acme"}, nil)
+	if expected := "SELECT COUNT(*), COALESCE(SUM(Amount), 0), COALESCE(ROUND(AVG(Amount), 2), 0), COALESCE(MIN(Amount), 0), COALESCE(MAX(Amount), 0) FROM invoice WHERE Tenant = $1"; statement != expected {
+		t.Errorf("Expected\n%s\nGot\n%s\n", expected, statement)
+	}
+}
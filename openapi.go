@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPIDocument describes every route initializeRoutes registers.
+// TestOpenAPIRoutes fails when the two drift apart.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// OpenAPIHandler serves the OpenAPI document. It is public, like the probes,
+// so clients can be generated without credentials.
+var OpenAPIHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	response.Write(openAPIDocument)
+})
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+type openAPIParameter struct {
+	Ref    string `json:"$ref"`
+	Name   string `json:"name"`
+	In     string `json:"in"`
+	Schema struct {
+		Pattern string `json:"pattern"`
+	} `json:"schema"`
+}
+
+type openAPISpec struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+// routesApp builds an App with every route registered, the development
+// token issuer as told, without connecting to anything.
+func routesApp(t *testing.T, devTokenIssuer bool) *App {
+	config := DefaultConfig()
+	config.Auth = AuthConfig{Secret: "secret", Issuer: "https://issuer/", Audience: "https://invoices/", TenantClaim: DefaultTenantClaim, DevTokenIssuer: devTokenIssuer}
+
+	auth, err := NewAuthenticator(config.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := NewPDFTemplate(config.PDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{
+		Config:  config,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Auth:    auth,
+		Limiter: NewRateLimiter(NewMemoryRateLimitStore(), config.RateLimits.Limits()),
+		PDF:     template,
+		Router:  mux.NewRouter(),
+	}
+	app.initializeRoutes()
+
+	return app
+}
+
+// openAPIPath turns a mux path template into an OpenAPI path, returning the
+// regular expression of each variable alongside.
+func openAPIPath(template string) (string, map[string]string) {
+	var path strings.Builder
+	patterns := make(map[string]string)
+
+	for i := 0; i < len(template); i++ {
+		if template[i] != '{' {
+			path.WriteByte(template[i])
+			continue
+		}
+
+		// Variables end at the brace matching theirs; the regexp may hold
+		// braces of its own
+		depth, end := 0, i
+		for ; end < len(template); end++ {
+			if template[end] == '{' {
+				depth++
+			} else if template[end] == '}' {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+
+		name, pattern, _ := strings.Cut(template[i+1:end], ":")
+		path.WriteString("{" + name + "}")
+		patterns[name] = pattern
+		i = end
+	}
+
+	return path.String(), patterns
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	path, patterns := openAPIPath("/v1/invoices/{year:19[5-9][0-9]|20[0-9]{2}}/{month:[1-9]|1[0-2]}/{document:[a-zA-Z0-9]{14}}")
+
+	if path != "/v1/invoices/{year}/{month}/{document}" {
+		t.Errorf("Expected the variables to be reduced to their names. Got %s\n", path)
+	}
+	if patterns["year"] != "19[5-9][0-9]|20[0-9]{2}" || patterns["month"] != "[1-9]|1[0-2]" || patterns["document"] != "[a-zA-Z0-9]{14}" {
+		t.Errorf("Expected the patterns of the variables. Got %v\n", patterns)
+	}
+}
+
+// TestOpenAPIRoutes fails when a route is missing from openapi.json, when
+// openapi.json describes a route that doesn't exist, or when their path
+// parameters disagree.
+func TestOpenAPIRoutes(t *testing.T) {
+	var spec openAPISpec
+	if err := json.Unmarshal(openAPIDocument, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	if spec.OpenAPI != "3.1.0" {
+		t.Errorf("Expected an OpenAPI 3.1.0 document. Got %q\n", spec.OpenAPI)
+	}
+
+	routes := make(map[string]map[string]string)
+	err := routesApp(t, true).Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouters match by prefix and serve nothing themselves
+			return nil
+		}
+
+		path, patterns := openAPIPath(template)
+		for _, method := range methods {
+			routes[method+" "+path] = patterns
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documented := make(map[string]bool)
+	for path, operations := range spec.Paths {
+		for method, raw := range operations {
+			key := strings.ToUpper(method) + " " + path
+			documented[key] = true
+
+			patterns, ok := routes[key]
+			if !ok {
+				t.Errorf("openapi.json describes %s, which isn't routed\n", key)
+				continue
+			}
+
+			var operation struct {
+				Parameters []openAPIParameter `json:"parameters"`
+			}
+			json.Unmarshal(raw, &operation)
+
+			inPath := make(map[string]bool)
+			for _, parameter := range operation.Parameters {
+				if parameter.Ref != "" {
+					parameter = spec.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+				}
+				if parameter.In != "path" {
+					continue
+				}
+
+				inPath[parameter.Name] = true
+				pattern, routed := patterns[parameter.Name]
+				if !routed {
+					t.Errorf("%s documents a path parameter %s the route lacks\n", key, parameter.Name)
+				} else if expected := "^(?:" + pattern + ")$"; parameter.Schema.Pattern != expected {
+					t.Errorf("%s documents %s as %q. Expected %q\n", key, parameter.Name, parameter.Schema.Pattern, expected)
+				}
+			}
+			for name := range patterns {
+				if !inPath[name] {
+					t.Errorf("%s doesn't document the path parameter %s\n", key, name)
+				}
+			}
+		}
+	}
+
+	for key := range routes {
+		if !documented[key] {
+			t.Errorf("%s is routed but missing from openapi.json\n", key)
+		}
+	}
+}
+
+func TestOpenAPIReferences(t *testing.T) {
+	var document interface{}
+	json.Unmarshal(openAPIDocument, &document)
+
+	reference := regexp.MustCompile(`^#/components/(\w+)/(\w+)$`)
+	components := document.(map[string]interface{})["components"].(map[string]interface{})
+
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if ref, ok := value["$ref"].(string); ok {
+				match := reference.FindStringSubmatch(ref)
+				if match == nil {
+					t.Errorf("Unexpected reference %s\n", ref)
+				} else if section, _ := components[match[1]].(map[string]interface{}); section[match[2]] == nil {
+					t.Errorf("Dangling reference %s\n", ref)
+				}
+			}
+			for _, child := range value {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range value {
+				walk(child)
+			}
+		}
+	}
+	walk(document)
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/openapi.json", nil)
+	response := httptest.NewRecorder()
+	routesApp(t, true).Router.ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected %d. Got %d\n", http.StatusOK, response.Code)
+	}
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected application/json. Got %s\n", contentType)
+	}
+	if response.Body.String() != string(openAPIDocument) {
+		t.Errorf("Expected the embedded document\n")
+	}
+}
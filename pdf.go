@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PDFTemplate renders printable invoices: the issuer and its logo on top,
+// then the invoice itself.
+type PDFTemplate struct {
+	config   PDFConfig
+	logo     []byte
+	logoType string
+}
+
+// NewPDFTemplate reads the logo of config up front, so a missing file
+// fails startup rather than every render.
+func NewPDFTemplate(config PDFConfig) (*PDFTemplate, error) {
+	template := &PDFTemplate{config: config}
+	if config.Logo == "" {
+		return template, nil
+	}
+
+	var err error
+	if template.logoType, err = logoImageType(config.Logo); err != nil {
+		return nil, err
+	}
+	if template.logo, err = os.ReadFile(config.Logo); err != nil {
+		return nil, fmt.Errorf("pdf logo: %v", err)
+	}
+
+	return template, nil
+}
+
+func logoImageType(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return "PNG", nil
+	case ".jpg", ".jpeg":
+		return "JPG", nil
+	default:
+		return "", fmt.Errorf("logo %s must be a PNG or JPEG file", path)
+	}
+}
+
+// formatDocument punctuates a CPF (11 digits) or CNPJ (14 characters) the
+// way they are printed. Anything else is left alone.
+func formatDocument(document string) string {
+	switch len(document) {
+	case 11:
+		return document[:3] + "." + document[3:6] + "." + document[6:9] + "-" + document[9:]
+	case 14:
+		return document[:2] + "." + document[2:5] + "." + document[5:8] + "/" + document[8:12] + "-" + document[12:]
+	default:
+		return document
+	}
+}
+
+// documentKind names a document by its length: a CPF for the 11 digits of a
+// person, a CNPJ otherwise.
+func documentKind(document string) string {
+	if len(document) == 11 {
+		return "CPF"
+	}
+
+	return "CNPJ"
+}
+
+// printedDate renders an invoice date as DD/MM/YYYY.
+func printedDate(value interface{}) string {
+	date, err := time.Parse("2006-01-02", exportDate(value))
+	if err != nil {
+		return ""
+	}
+
+	return date.Format("02/01/2006")
+}
+
+// Render writes invoice as a one page A4 PDF to w.
+func (template *PDFTemplate) Render(w io.Writer, invoice Invoice) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.SetAutoPageBreak(true, 25)
+	pdf.SetCreationDate(time.Now().UTC())
+	pdf.SetTitle(template.config.Title, true)
+
+	// The core fonts are Latin-1; accents need translating from UTF-8
+	text := pdf.UnicodeTranslatorFromDescriptor("")
+	width, _ := pdf.GetPageSize()
+	left, _, right, _ := pdf.GetMargins()
+	body := width - left - right
+
+	if footer := template.config.Footer; footer != "" {
+		pdf.SetFooterFunc(func() {
+			pdf.SetY(-20)
+			pdf.SetFont("Helvetica", "", 8)
+			pdf.SetTextColor(110, 110, 110)
+			pdf.CellFormat(0, 5, text(footer), "", 0, "C", false, 0, "")
+		})
+	}
+
+	pdf.AddPage()
+
+	// Issuer, to the right of the logo
+	issuerX := left
+	if template.logo != nil {
+		options := gofpdf.ImageOptions{ImageType: template.logoType}
+		pdf.RegisterImageOptionsReader("logo", options, bytes.NewReader(template.logo))
+		pdf.ImageOptions("logo", left, 20, 0, 20, false, options, 0, "")
+		issuerX = left + 50
+	}
+
+	pdf.SetXY(issuerX, 20)
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(0, 6, text(template.config.IssuerName), "", 2, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 9)
+	if template.config.IssuerDocument != "" {
+		pdf.CellFormat(0, 5, documentKind(template.config.IssuerDocument)+" "+formatDocument(template.config.IssuerDocument), "", 2, "L", false, 0, "")
+	}
+	if template.config.IssuerAddress != "" {
+		pdf.MultiCell(body-(issuerX-left), 5, text(template.config.IssuerAddress), "", "L", false)
+	}
+
+	// Title, with the reference on the right
+	pdf.SetXY(left, 50)
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(body/2, 10, text(template.config.Title), "B", 0, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.CellFormat(body/2, 10, fmt.Sprintf("%02d/%04d", invoice.ReferenceMonth, invoice.ReferenceYear), "B", 1, "R", false, 0, "")
+	pdf.Ln(6)
+
+	field := func(label, value string) {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(40, 7, text(label), "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(body-40, 7, text(value), "", "L", false)
+	}
+
+	field("Document", formatDocument(invoice.Document))
+	field("Issued on", printedDate(invoice.CreatedAt))
+	field("Description", invoice.Description)
+	if !invoice.IsActive {
+		field("Deactivated on", printedDate(invoice.DeactiveAt))
+	}
+
+	pdf.Ln(6)
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(body-50, 10, "Total", "TB", 0, "L", false, 0, "")
+	pdf.CellFormat(50, 10, "R$ "+formatBRL(strconv.FormatFloat(float64(invoice.Amount), 'f', 2, 64)), "TB", 1, "R", false, 0, "")
+
+	if !invoice.IsActive {
+		pdf.Ln(10)
+		pdf.SetFont("Helvetica", "B", 24)
+		pdf.SetTextColor(190, 30, 30)
+		pdf.CellFormat(0, 12, "DEACTIVATED", "", 1, "C", false, 0, "")
+	}
+
+	return pdf.Output(w)
+}
+
+// InvoicePDF serves the invoice the year/month/document route names as a
+// PDF when Negotiate picked application/pdf for the request, and otherwise
+// hands over to next. Of several invoices for the same reference, an active
+// one is printed.
+func InvoicePDF(template *PDFTemplate) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if responseFormat(response) != "application/pdf" {
+				next.ServeHTTP(response, request)
+				return
+			}
+
+			ctx, span := tracer.Start(request.Context(), "InvoicePDFHandler")
+			defer span.End()
+
+			sqlParams := invoiceQuery(request)
+			sqlParams["limit"], sqlParams["offset"] = 100, 0
+
+			invoices, err := GetInvoices(ctx, dbConnection, sqlParams)
+			if err != nil {
+				respondWithStoreError(response, request, "Invoice", err)
+				return
+			}
+			if len(invoices) == 0 {
+				respondWithStoreError(response, request, "Invoice", ErrNotFound)
+				return
+			}
+
+			template.serve(response, request.WithContext(ctx), invoices)
+		})
+	}
+}
+
+// serve responds with the PDF of the first active invoice of invoices, or
+// of the first one when none is active.
+func (template *PDFTemplate) serve(response http.ResponseWriter, request *http.Request, invoices []Invoice) {
+	invoice := invoices[0]
+	for _, candidate := range invoices {
+		if candidate.IsActive {
+			invoice = candidate
+			break
+		}
+	}
+
+	var document bytes.Buffer
+	if err := template.Render(&document, invoice); err != nil {
+		LoggerFromContext(request.Context()).Error("rendering invoice PDF", "error", err)
+		RespondWithError(response, http.StatusInternalServerError, "Could not render the invoice")
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/pdf")
+	response.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="invoice-%04d-%02d-%s.pdf"`, invoice.ReferenceYear, invoice.ReferenceMonth, invoice.Document))
+	response.WriteHeader(http.StatusOK)
+	document.WriteTo(response)
+}
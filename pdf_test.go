@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatDocument(t *testing.T) {
+	for document, expected := range map[string]string{
+		"12345678000195": "12.345.678/0001-95",
+		"12ABC34501DE35": "12.ABC.345/01DE-35",
+		"12345678909":    "123.456.789-09",
+		"123":            "123",
+	} {
+		if formatted := formatDocument(document); formatted != expected {
+			t.Errorf("Expected %s as %s. Got %s\n", document, expected, formatted)
+		}
+	}
+
+	for document, expected := range map[string]string{"12345678909": "CPF", "12345678000195": "CNPJ", "12ABC34501DE35": "CNPJ"} {
+		if kind := documentKind(document); kind != expected {
+			t.Errorf("Expected %s to be a %s. Got %s\n", document, expected, kind)
+		}
+	}
+}
+
+func TestNegotiatePDF(t *testing.T) {
+	template, _ := NewPDFTemplate(PDFConfig{Title: "Invoice"})
+
+	for accept, expected := range map[string]string{
+		"":                 "",
+		"*/*":              "",
+		"application/json": "",
+		"application/pdf":  "application/pdf",
+		"application/json, application/pdf;q=0.1": "",
+		"application/pdf;q=0.1, application/json": "",
+		"application/pdf, application/json;q=0.5": "application/pdf",
+		"application/pdf;q=0.0, application/json": "",
+		"application/pdf;q=0.000, */*":            "",
+	} {
+		var format string
+		var passed bool
+		listing := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			passed = true
+		})
+
+		handler := Negotiate("application/pdf")(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			format = responseFormat(response)
+			if format != "application/pdf" {
+				InvoicePDF(template)(listing).ServeHTTP(response, request)
+			}
+		}))
+
+		request, _ := http.NewRequest("GET", "/invoices/2019/7/12345678901234", nil)
+		request.Header.Set("Accept", accept)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if format != expected {
+			t.Errorf("Expected %q for Accept %q. Got %q\n", expected, accept, format)
+		}
+		if expected == "" && !passed {
+			t.Errorf("Expected Accept %q to be answered by the listing\n", accept)
+		}
+	}
+}
+
+func TestServeInvoicePDF(t *testing.T) {
+	template, _ := NewPDFTemplate(PDFConfig{Title: "Invoice", IssuerDocument: "12345678909"})
+	invoices := []Invoice{
+		{ReferenceMonth: 7, ReferenceYear: 2019, Document: "43210ABCD54321", Amount: 10, CreatedAt: "2019-07-01"},
+		{ReferenceMonth: 7, ReferenceYear: 2019, Document: "43210ABCD54321", Amount: 20, CreatedAt: "2019-07-02", IsActive: true},
+	}
+
+	handler := Negotiate("application/pdf")(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		template.serve(response, request, invoices)
+	}))
+
+	request, _ := http.NewRequest("GET", "/invoices/2019/7/43210ABCD54321", nil)
+	request.Header.Set("Accept", "application/pdf")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Content-Type") != "application/pdf" || !bytes.HasPrefix(response.Body.Bytes(), []byte("%PDF-")) {
+		t.Errorf("Expected a PDF. Got %s\n", response.Header().Get("Content-Type"))
+	}
+	if disposition := response.Header().Get("Content-Disposition"); disposition != `inline; filename="invoice-2019-07-43210ABCD54321.pdf"` {
+		t.Errorf("Unexpected Content-Disposition %s\n", disposition)
+	}
+}
+
+func TestRenderInvoicePDF(t *testing.T) {
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	file, err := os.Create(logo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(file, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	file.Close()
+
+	template, err := NewPDFTemplate(PDFConfig{
+		Title:          "Nota de serviço",
+		Logo:           logo,
+		IssuerName:     "Serviços Ltda.",
+		IssuerDocument: "12345678000195",
+		IssuerAddress:  "Av. Paulista, 1000\nSão Paulo - SP",
+		Footer:         "Obrigado!",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoice := Invoice{ReferenceMonth: 7, ReferenceYear: 2019, Document: "43210ABCD54321", Description: "Manutenção", Amount: 1234.5, CreatedAt: "2019-07-01", DeactiveAt: "2019-08-02"}
+
+	var document bytes.Buffer
+	if err := template.Render(&document, invoice); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(document.Bytes(), []byte("%PDF-")) {
+		t.Errorf("Expected a PDF. Got %q\n", document.Bytes()[:16])
+	}
+
+	if _, err := NewPDFTemplate(PDFConfig{Logo: "logo.gif"}); err == nil {
+		t.Error("Expected a GIF logo to be refused")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route classes, each with its own rate limit.
+const (
+	RouteClassRead  = "read"
+	RouteClassWrite = "write"
+	RouteClassAdmin = "admin"
+)
+
+// RateLimit allows Requests per Per, in bursts of up to Requests. The zero
+// value means no limit.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (limit RateLimit) String() string {
+	if limit.Requests == 0 {
+		return "off"
+	}
+
+	return strconv.Itoa(limit.Requests) + "/" + limit.Per.String()
+}
+
+// Set parses "<requests>/<duration>" or "off", so a RateLimit can be used
+// as a flag.Value.
+func (limit *RateLimit) Set(value string) error {
+	if value == "off" {
+		*limit = RateLimit{}
+		return nil
+	}
+
+	parsed, err := ParseRateLimit(value)
+	if err != nil {
+		return err
+	}
+
+	*limit = parsed
+	return nil
+}
+
+func (limit *RateLimit) UnmarshalText(text []byte) error {
+	return limit.Set(string(text))
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, when it isn't
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the buckets. MemoryRateLimitStore is enough for a
+// single instance; replicas sharing a limit need a shared implementation,
+// e.g. backed by Redis.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+type MemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*bucket)}
+}
+
+func (store *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Per.Seconds()
+
+	b, ok := store.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		store.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rate)
+		b.last = now
+	}
+
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((capacity - b.tokens) / rate)
+	b.full = now.Add(result.Reset)
+
+	store.takes++
+	if store.takes%10000 == 0 {
+		store.sweep(now)
+	}
+
+	return result, nil
+}
+
+// sweep drops buckets idle for long enough to have refilled completely; they
+// are recreated full on the next request anyway.
+func (store *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range store.buckets {
+		if now.After(b.full) {
+			delete(store.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+type RateLimiter struct {
+	Store  RateLimitStore
+	Limits map[string]RateLimit
+}
+
+func NewRateLimiter(store RateLimitStore, limits map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{Store: store, Limits: limits}
+}
+
+func ParseRateLimit(value string) (RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("%q is not <requests>/<duration>", value)
+	}
+
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return RateLimit{}, fmt.Errorf("%q is not a positive number of requests", parts[0])
+	}
+
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return RateLimit{}, fmt.Errorf("%q is not a positive duration", parts[1])
+	}
+
+	return RateLimit{Requests: requests, Per: per}, nil
+}
+
+// rateLimitKey identifies the client a request is counted against: the API
+// key when one was used, the token subject otherwise. Key IDs are unique
+// across tenants, but subjects are not, as the IdPs of two tenants may hand
+// out the same one; they are counted within their tenant, quoted so no
+// tenant and subject can pass for another.
+func rateLimitKey(principal *Principal) string {
+	if principal.KeyID != 0 {
+		return "apikey:" + strconv.FormatInt(principal.KeyID, 10)
+	}
+
+	return "sub:" + strconv.Quote(principal.Tenant) + ":" + principal.Subject
+}
+
+// Middleware limits requests of the given route class. It must run after
+// AuthMiddleware. When the store fails, requests are let through rather than
+// turning a limiter outage into an API outage.
+func (limiter *RateLimiter) Middleware(class string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limit, ok := limiter.Limits[class]
+		if !ok {
+			return next
+		}
+
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			principal, ok := PrincipalFromContext(request.Context())
+			if !ok {
+				next.ServeHTTP(response, request)
+				return
+			}
+
+			key := class + ":" + rateLimitKey(principal)
+			result, err := limiter.Store.Take(request.Context(), key, limit, time.Now())
+
+			if err != nil {
+				LoggerFromContext(request.Context()).Error("rate limiter unavailable", "error", err)
+				next.ServeHTTP(response, request)
+				return
+			}
+
+			header := response.Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+			if !result.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				RespondWithError(response, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+
+			next.ServeHTTP(response, request)
+		})
+	}
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
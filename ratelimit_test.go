@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Requests: 3, Per: 3 * time.Second}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if result, _ := store.Take(context.Background(), "key", limit, now); !result.Allowed {
+			t.Fatalf("Request %d of the burst was limited\n", i+1)
+		}
+	}
+
+	result, _ := store.Take(context.Background(), "key", limit, now)
+	if result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("Expected a denial with a 1s retry, got %+v\n", result)
+	}
+
+	if result, _ := store.Take(context.Background(), "other", limit, now); !result.Allowed {
+		t.Errorf("Buckets are not independent per key\n")
+	}
+
+	if result, _ := store.Take(context.Background(), "key", limit, now.Add(time.Second)); !result.Allowed {
+		t.Errorf("Bucket did not refill after 1s\n")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore(), map[string]RateLimit{
+		RouteClassRead: {Requests: 1, Per: time.Minute},
+	})
+	handler := limiter.Middleware(RouteClassRead)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusOK)
+	}))
+
+	principal := &Principal{Subject: "ratelimit@clients"}
+	ctx := context.WithValue(context.Background(), principalContextKey, principal)
+
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request.WithContext(ctx))
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if remaining := response.Header().Get("RateLimit-Remaining"); remaining != "0" {
+		t.Errorf("Expected RateLimit-Remaining 0. Got %q\n", remaining)
+	}
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request.WithContext(ctx))
+
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Expected Retry-After 60. Got %q\n", retryAfter)
+	}
+}
+
+func TestRateLimitKeyTenant(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore(), map[string]RateLimit{
+		RouteClassRead: {Requests: 1, Per: time.Minute},
+	})
+	handler := limiter.Middleware(RouteClassRead)(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusOK)
+	}))
+
+	// The same subject in two tenants, and pairs that would read alike unquoted
+	for _, principals := range [][2]*Principal{
+		{{Subject: "batch@clients", Tenant: "acme"}, {Subject: "batch@clients", Tenant: "globex"}},
+		{{Subject: "b:c", Tenant: "a"}, {Subject: "c", Tenant: "a:b"}},
+	} {
+		for _, principal := range principals {
+			ctx := context.WithValue(context.Background(), principalContextKey, principal)
+			request, _ := http.NewRequest("GET", "/invoices", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request.WithContext(ctx))
+
+			checkResponseCode(t, http.StatusOK, response.Code)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StatementLine is an invoice of a statement with the running balance of
+// the active invoices up to it.
+type StatementLine struct {
+	Invoice
+	Balance float64
+}
+
+type StatementYear struct {
+	Year  int     `json:"year"`
+	Count int     `json:"count"`
+	Total float64 `json:"total"`
+}
+
+// Statement is the customer view of a Document: its invoices in reference
+// order, the totals of the active ones per year and overall, and how many
+// were deactivated. Deactivated invoices are listed but count for nothing.
+type Statement struct {
+	Document    string          `json:"document"`
+	Invoices    []StatementLine `json:"invoices"`
+	Years       []StatementYear `json:"years"`
+	Total       float64         `json:"total"`
+	Deactivated int             `json:"deactivated"`
+}
+
+func buildStatement(document string, invoices []Invoice) Statement {
+	sort.SliceStable(invoices, func(i, j int) bool {
+		a, b := invoices[i], invoices[j]
+		if a.ReferenceYear != b.ReferenceYear {
+			return a.ReferenceYear < b.ReferenceYear
+		}
+		if a.ReferenceMonth != b.ReferenceMonth {
+			return a.ReferenceMonth < b.ReferenceMonth
+		}
+		return a.CreatedAt < b.CreatedAt
+	})
+
+	statement := Statement{Document: document, Invoices: []StatementLine{}, Years: []StatementYear{}}
+	balance := 0.0
+
+	for _, invoice := range invoices {
+		if !invoice.IsActive {
+			statement.Deactivated++
+		} else {
+			balance = math.Round((balance+float64(invoice.Amount))*100) / 100
+
+			if n := len(statement.Years); n == 0 || statement.Years[n-1].Year != invoice.ReferenceYear {
+				statement.Years = append(statement.Years, StatementYear{Year: invoice.ReferenceYear})
+			}
+			year := &statement.Years[len(statement.Years)-1]
+			year.Count++
+			year.Total = math.Round((year.Total+float64(invoice.Amount))*100) / 100
+		}
+
+		statement.Invoices = append(statement.Invoices, StatementLine{invoice, balance})
+	}
+
+	statement.Total = balance
+
+	return statement
+}
+
+// GetStatement builds the statement of the document params filter on.
+func GetStatement(ctx context.Context, db *sql.DB, params map[string]interface{}) (statement Statement, err error) {
+	defer observeQuery("statement", time.Now())
+	ctx, span := tracer.Start(ctx, "GetStatement")
+	defer func() { endSpan(span, err) }()
+
+	var invoices []Invoice
+	err = forEachInvoice(ctx, db, params, func(invoice Invoice) error {
+		invoices = append(invoices, invoice)
+		return nil
+	})
+
+	if err != nil {
+		return Statement{}, err
+	}
+
+	return buildStatement(params["where"].(map[string]string)["document"], invoices), nil
+}
+
+// StatementHandler returns the statement of a Document, optionally between
+// the from and to months, as JSON or, with format=csv or text/csv winning
+// the negotiation, as a CSV download of its invoices with the running balance.
+var StatementHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "StatementHandler")
+	defer span.End()
+
+	query := request.URL.Query()
+	document := mux.Vars(request)["document"]
+
+	sqlParams := map[string]interface{}{
+		"tenant": tenantFromRequest(request),
+		"where":  map[string]string{"document": document},
+	}
+
+	if query.Get("from") != "" || query.Get("to") != "" {
+		from, to := 0, 9999*12+11
+		var err error
+
+		if value := query.Get("from"); value != "" {
+			if from, err = parsePeriod(value); err != nil {
+				RespondWithError(response, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if value := query.Get("to"); value != "" {
+			if to, err = parsePeriod(value); err != nil {
+				RespondWithError(response, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		sqlParams["period"] = [2]int{from, to}
+	}
+
+	format := query.Get("format")
+	if format == "" && responseFormat(response) == "text/csv" {
+		format = "csv"
+	}
+	if format != "" && format != "json" && format != "csv" {
+		RespondWithError(response, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	var encoder *csvInvoiceEncoder
+	if format == "csv" {
+		delimiter, brl, err := csvOptions(query)
+		if err != nil {
+			RespondWithError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		encoder = newCSVInvoiceEncoder(response, delimiter, brl)
+		balance := "Balance"
+		if apiVersion(ctx) != 0 {
+			balance = "balance"
+		}
+		encoder.header = append(append([]string{}, csvHeader(ctx)...), balance)
+	}
+
+	statement, err := GetStatement(ctx, dbConnection, sqlParams)
+	if err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
+	}
+
+	if encoder == nil {
+		Respond(response, http.StatusOK, presentStatement(ctx, statement))
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	response.Header().Set("Content-Disposition", `attachment; filename="statement-`+document+`.csv"`)
+	response.WriteHeader(http.StatusOK)
+
+	if err := writeStatementCSV(encoder, statement); err != nil {
+		// As with exports, cut the response short so the client can't take
+		// a partial statement for a complete one
+		LoggerFromContext(ctx).Error("statement aborted", "document", document, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+})
+
+// writeStatementCSV writes the lines of statement, each with its balance,
+// and reports the first error writing them.
+func writeStatementCSV(encoder *csvInvoiceEncoder, statement Statement) error {
+	for _, line := range statement.Invoices {
+		if err := encoder.write(line.Invoice, encoder.formatAmount(line.Balance)); err != nil {
+			return err
+		}
+	}
+
+	return encoder.Flush()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBuildStatement(t *testing.T) {
+	invoices := []Invoice{
+		{ReferenceYear: 2016, ReferenceMonth: 2, Amount: 20, IsActive: true, CreatedAt: "2016-02-01"},
+		{ReferenceYear: 2015, ReferenceMonth: 11, Amount: 10.25, IsActive: true, CreatedAt: "2015-11-03"},
+		{ReferenceYear: 2016, ReferenceMonth: 1, Amount: 500, IsActive: false, CreatedAt: "2016-01-15"},
+		{ReferenceYear: 2015, ReferenceMonth: 11, Amount: 0.5, IsActive: true, CreatedAt: "2015-11-01"},
+	}
+
+	statement := buildStatement("43210ABCD54321", invoices)
+
+	balances := []float64{0.5, 10.75, 10.75, 30.75}
+	if len(statement.Invoices) != len(balances) {
+		t.Fatalf("Expected %d lines. Got %d\n", len(balances), len(statement.Invoices))
+	}
+	for i, line := range statement.Invoices {
+		if line.Balance != balances[i] {
+			t.Errorf("Expected balance %v on line %d. Got %v\n", balances[i], i, line.Balance)
+		}
+	}
+	if statement.Invoices[0].CreatedAt != "2015-11-01" || statement.Invoices[2].IsActive {
+		t.Errorf("Unexpected order: %+v\n", statement.Invoices)
+	}
+
+	years := []StatementYear{{2015, 2, 10.75}, {2016, 1, 20}}
+	if len(statement.Years) != len(years) || statement.Years[0] != years[0] || statement.Years[1] != years[1] {
+		t.Errorf("Expected years %+v. Got %+v\n", years, statement.Years)
+	}
+	if statement.Total != 30.75 || statement.Deactivated != 1 {
+		t.Errorf("Expected total 30.75 and 1 deactivated. Got %v and %d\n", statement.Total, statement.Deactivated)
+	}
+}
+
+// brokenWriter stands for a client that went away after limit bytes.
+type brokenWriter struct {
+	limit int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, errors.New("connection reset by peer")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteStatementCSV(t *testing.T) {
+	invoices := make([]Invoice, 200)
+	for i := range invoices {
+		invoices[i] = Invoice{ReferenceYear: 2019, ReferenceMonth: 1, Document: "43210ABCD54321", Description: strings.Repeat("x", 64), Amount: 1, IsActive: true, CreatedAt: "2019-01-01"}
+	}
+	statement := buildStatement("43210ABCD54321", invoices)
+
+	var buffer bytes.Buffer
+	encoder := newCSVInvoiceEncoder(&buffer, ',', false)
+	encoder.header = append(append([]string{}, exportHeader...), "Balance")
+	if err := writeStatementCSV(encoder, statement); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buffer.String(), "\n"); lines != len(invoices)+1 {
+		t.Errorf("Expected %d lines. Got %d\n", len(invoices)+1, lines)
+	}
+
+	// Failures show both midway, once the buffer of the writer fills up,
+	// and on the final flush
+	for _, limit := range []int{0, 100} {
+		encoder = newCSVInvoiceEncoder(&brokenWriter{limit}, ',', false)
+		if err := writeStatementCSV(encoder, statement); err == nil {
+			t.Errorf("Expected the write error to be reported with %d bytes written\n", limit)
+		}
+
+		encoder = newCSVInvoiceEncoder(&brokenWriter{limit}, ',', false)
+		if err := writeStatementCSV(encoder, buildStatement("43210ABCD54321", invoices[:1])); err == nil {
+			t.Errorf("Expected the flush error to be reported with %d bytes written\n", limit)
+		}
+	}
+}
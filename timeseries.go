@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// maxTimeseriesMonths bounds the range of a series to a century.
+const maxTimeseriesMonths = 1200
+
+// intervalMonths is the length of each series interval.
+var intervalMonths = map[string]int{"month": 1, "quarter": 3, "year": 12}
+
+// TimeseriesBucket totals one period of a series. Change and ChangePercent
+// compare Sum with the previous bucket; they are null for the first one, and
+// ChangePercent also after a bucket summing zero.
+type TimeseriesBucket struct {
+	Period        string   `json:"period"`
+	Count         int64    `json:"count"`
+	Sum           float64  `json:"sum"`
+	Change        *float64 `json:"change"`
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+// parsePeriod reads a YYYY-MM month as a count of months since year 0.
+func parsePeriod(value string) (int, error) {
+	month, err := time.Parse("2006-01", value)
+	if err != nil {
+		return 0, &ValidationError{fmt.Sprintf("%q is not a YYYY-MM month", value)}
+	}
+
+	return month.Year()*12 + int(month.Month()) - 1, nil
+}
+
+func periodLabel(start int, interval string) string {
+	year, month := start/12, start%12+1
+
+	switch interval {
+	case "year":
+		return fmt.Sprintf("%04d", year)
+	case "quarter":
+		return fmt.Sprintf("%04d-Q%d", year, (month-1)/3+1)
+	default:
+		return fmt.Sprintf("%04d-%02d", year, month)
+	}
+}
+
+// buildTimeseries spreads monthly summaries over one bucket per interval
+// from the month from to the month to, both included, leaving empty
+// periods at zero. from and to must be aligned on the interval.
+func buildTimeseries(summaries []InvoiceSummary, from, to int, interval string) []TimeseriesBucket {
+	length := intervalMonths[interval]
+	buckets := make([]TimeseriesBucket, (to-from)/length+1)
+
+	for i := range buckets {
+		buckets[i].Period = periodLabel(from+i*length, interval)
+	}
+
+	for _, summary := range summaries {
+		month := *summary.Year*12 + *summary.Month - 1
+		if month < from || month > to {
+			continue
+		}
+
+		bucket := &buckets[(month-from)/length]
+		bucket.Count += summary.Count
+		bucket.Sum += summary.Sum
+	}
+
+	for i := range buckets {
+		buckets[i].Sum = math.Round(buckets[i].Sum*100) / 100
+		if i == 0 {
+			continue
+		}
+
+		previous := buckets[i-1].Sum
+		change := math.Round((buckets[i].Sum-previous)*100) / 100
+		buckets[i].Change = &change
+
+		if previous != 0 {
+			percent := math.Round(change/math.Abs(previous)*10000) / 100
+			buckets[i].ChangePercent = &percent
+		}
+	}
+
+	return buckets
+}
+
+// TimeseriesHandler returns invoice totals as a continuous series of
+// months, quarters or years. from and to default to the twelve months up to
+// the current one, and are widened to whole intervals. Only active invoices
+// count unless status asks for the deleted ones.
+var TimeseriesHandler = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+	ctx, span := tracer.Start(request.Context(), "TimeseriesHandler")
+	defer span.End()
+
+	query := request.URL.Query()
+
+	// from and to pick the periods; year or month would silently narrow them
+	if query.Has("year") || query.Has("month") {
+		RespondWithError(response, http.StatusBadRequest, "Filter the series with from and to, not year or month")
+		return
+	}
+
+	status := query.Get("status")
+	if status == "" {
+		status = "active"
+	}
+	if status != "active" && status != "deleted" {
+		RespondWithError(response, http.StatusBadRequest, "status must be active or deleted")
+		return
+	}
+
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "month"
+	}
+	length, ok := intervalMonths[interval]
+	if !ok {
+		RespondWithError(response, http.StatusBadRequest, "interval must be month, quarter or year")
+		return
+	}
+
+	now := time.Now()
+	to := now.Year()*12 + int(now.Month()) - 1
+	from := to - 11
+
+	var err error
+	if value := query.Get("to"); value != "" {
+		if to, err = parsePeriod(value); err != nil {
+			RespondWithError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+		from = to - 11
+	}
+	if value := query.Get("from"); value != "" {
+		if from, err = parsePeriod(value); err != nil {
+			RespondWithError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	from -= from % length
+	to += length - 1 - to%length
+
+	if from > to || to-from >= maxTimeseriesMonths {
+		RespondWithError(response, http.StatusBadRequest, fmt.Sprintf("from must come before to, at most %d months apart", maxTimeseriesMonths))
+		return
+	}
+
+	sqlParams := map[string]interface{}{
+		"tenant": tenantFromRequest(request),
+		"period": [2]int{from, to},
+		"status": status,
+	}
+	if document := query.Get("document"); document != "" {
+		sqlParams["where"] = map[string]string{"document": document}
+	}
+
+	summaries, err := SummarizeInvoices(ctx, dbConnection, sqlParams, []string{"year", "month"})
+	if err != nil {
+		respondWithStoreError(response, request, "Invoice", err)
+		return
+	}
+
+	Respond(response, http.StatusOK, buildTimeseries(summaries, from, to, interval))
+})
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func summaryOf(year, month int, count int64, sum float64) InvoiceSummary {
+	return InvoiceSummary{Year: &year, Month: &month, Count: count, Sum: sum}
+}
+
+func TestBuildTimeseries(t *testing.T) {
+	from, _ := parsePeriod("2015-01")
+	to, _ := parsePeriod("2015-12")
+	summaries := []InvoiceSummary{
+		summaryOf(2015, 1, 2, 100),
+		summaryOf(2015, 3, 1, 50),
+		summaryOf(2015, 8, 4, 200),
+	}
+
+	buckets := buildTimeseries(summaries, from, to, "quarter")
+
+	if len(buckets) != 4 {
+		t.Fatalf("Expected 4 quarters. Got %d\n", len(buckets))
+	}
+
+	expected := []struct {
+		period  string
+		count   int64
+		sum     float64
+		change  float64
+		percent float64
+	}{
+		{"2015-Q1", 3, 150, 0, 0},
+		{"2015-Q2", 0, 0, -150, -100},
+		{"2015-Q3", 4, 200, 200, 0},
+		{"2015-Q4", 0, 0, -200, -100},
+	}
+	for i, bucket := range buckets {
+		want := expected[i]
+		if bucket.Period != want.period || bucket.Count != want.count || bucket.Sum != want.sum {
+			t.Errorf("Expected bucket %+v. Got %+v\n", want, bucket)
+		}
+		if i > 0 && *bucket.Change != want.change {
+			t.Errorf("%s: expected change %v. Got %v\n", bucket.Period, want.change, *bucket.Change)
+		}
+	}
+
+	if buckets[0].Change != nil || buckets[2].ChangePercent != nil || *buckets[1].ChangePercent != -100 {
+		t.Errorf("Unexpected period-over-period changes: %+v\n", buckets)
+	}
+
+	if months := buildTimeseries(nil, from, to, "month"); len(months) != 12 || months[11].Period != "2015-12" {
+		t.Errorf("Expected 12 zero-filled months. Got %+v\n", months)
+	}
+}
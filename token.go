@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const DefaultTokenTTL = time.Hour
+
+// TokenRequest describes a token signed by the local issuer.
+type TokenRequest struct {
+	Subject string
+	Tenant  string
+	Scopes  []string
+	TTL     time.Duration
+}
+
+// MintToken signs a token that this Authenticator will accept, without going
+// through Auth0. It is meant for development and tests only.
+func (auth *Authenticator) MintToken(tokenRequest TokenRequest) (string, error) {
+	if tokenRequest.Subject == "" {
+		return "", errors.New("token subject must not be empty")
+	}
+
+	ttl := tokenRequest.TTL
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.HS256, Key: auth.secret},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Claims: jwt.Claims{
+			Issuer:    auth.issuer,
+			Subject:   tokenRequest.Subject,
+			Audience:  auth.audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Scope: strings.Join(tokenRequest.Scopes, " "),
+	}
+
+	builder := jwt.Signed(signer).Claims(claims)
+	if tokenRequest.Tenant != "" {
+		builder = builder.Claims(map[string]interface{}{auth.tenantClaim: tokenRequest.Tenant})
+	}
+
+	return builder.CompactSerialize()
+}
+
+// DevTokenHandler mimics the client_credentials grant of Auth0's
+// /oauth/token, so clients such as getAPIKey in main_test.go can run against
+// a local instance. The client_id becomes the token subject and no secret is
+// checked, hence it is only routed when auth.dev_token_issuer is set.
+func DevTokenHandler(auth *Authenticator) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+
+		var payload struct {
+			ClientID     string `json:"client_id"`
+			GrantType    string `json:"grant_type"`
+			Scope        string `json:"scope"`
+			Organization string `json:"organization"`
+		}
+		if err := decodeBody(request, &payload); err != nil {
+			respondWithBodyError(response, err)
+			return
+		}
+
+		if payload.ClientID == "" || payload.GrantType != "client_credentials" {
+			RespondWithError(response, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+
+		token, err := auth.MintToken(TokenRequest{
+			Subject: payload.ClientID + "@clients",
+			Tenant:  payload.Organization,
+			Scopes:  strings.Fields(payload.Scope),
+			TTL:     DefaultTokenTTL,
+		})
+		if err != nil {
+			LoggerFromContext(request.Context()).Error("signing token", "error", err)
+			RespondWithError(response, http.StatusInternalServerError, "Could not sign the token")
+			return
+		}
+
+		Respond(response, http.StatusOK, map[string]interface{}{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(DefaultTokenTTL.Seconds()),
+		})
+	})
+}
+
+// runTokenCommand implements "token mint", printing a locally signed token
+// for the configured secret, audience and issuer.
+func runTokenCommand(args []string, output io.Writer) error {
+	if len(args) == 0 || args[0] != "mint" {
+		return errors.New("usage: token mint [-config file] [-sub subject] [-tenant org] [-scope \"a b\"] [-ttl 1h]")
+	}
+
+	flags := flag.NewFlagSet("token mint", flag.ContinueOnError)
+	configPath := flags.String("config", "", "YAML configuration file (env APP_CONFIG)")
+	subject := flags.String("sub", "dev@clients", "token subject")
+	tenant := flags.String("tenant", "", "tenant claim, defaults to the subject")
+	scope := flags.String("scope", "", "space separated scopes")
+	ttl := flags.Duration("ttl", DefaultTokenTTL, "token lifetime")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var configArgs []string
+	if *configPath != "" {
+		configArgs = []string{"-config", *configPath}
+	}
+
+	// Only the auth settings matter here, so the rest is not validated
+	config, err := loadConfig(configArgs)
+	if err != nil {
+		return err
+	}
+
+	auth, err := NewAuthenticator(config.Auth)
+	if err != nil {
+		return err
+	}
+
+	token, err := auth.MintToken(TokenRequest{Subject: *subject, Tenant: *tenant, Scopes: strings.Fields(*scope), TTL: *ttl})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(output, token)
+	return err
+}
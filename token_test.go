@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDevTokenIssuerGate(t *testing.T) {
+	for devTokenIssuer, expected := range map[bool]int{false: http.StatusNotFound, true: http.StatusOK} {
+		request, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(`{"client_id": "batch", "grant_type": "client_credentials"}`))
+		response := httptest.NewRecorder()
+		routesApp(t, devTokenIssuer).Router.ServeHTTP(response, request)
+
+		if response.Code != expected {
+			t.Errorf("Expected %d with dev_token_issuer %v. Got %d\n", expected, devTokenIssuer, response.Code)
+		}
+	}
+}
+
+func TestDevTokenHandler(t *testing.T) {
+	auth, _ := NewAuthenticator(AuthConfig{Secret: "secret", Issuer: "https://issuer/", Audience: "https://invoices/", TenantClaim: DefaultTenantClaim})
+	handler := DevTokenHandler(auth)
+
+	for _, test := range []struct {
+		payload string
+		code    int
+		tenant  string
+		scopes  []string
+	}{
+		{`{"client_id": "batch", "grant_type": "client_credentials", "scope": "invoices:read admin:apikeys", "organization": "acme"}`, http.StatusOK, "acme", []string{"invoices:read", "admin:apikeys"}},
+		{`{"client_id": "batch", "grant_type": "client_credentials"}`, http.StatusOK, "batch@clients", nil},
+		{`{"grant_type": "client_credentials", "organization": "acme"}`, http.StatusBadRequest, "", nil},
+		{`{"client_id": "batch", "grant_type": "password"}`, http.StatusBadRequest, "", nil},
+	} {
+		request, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(test.payload))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		checkResponseCode(t, test.code, response.Code)
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var body map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &body)
+		token, _ := body["access_token"].(string)
+
+		request, _ = http.NewRequest("GET", "/invoices", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		principal, err := auth.Authenticate(request)
+		if err != nil {
+			t.Errorf("The token for %s doesn't authenticate: %v\n", test.payload, err)
+			continue
+		}
+		if principal.Subject != "batch@clients" || principal.Tenant != test.tenant || strings.Join(principal.Scopes, " ") != strings.Join(test.scopes, " ") {
+			t.Errorf("Unexpected principal %+v for %s\n", principal, test.payload)
+		}
+	}
+}
+
+func TestRunTokenCommand(t *testing.T) {
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+auth:
+  secret: file_secret
+  issuer: https://file/
+  audience: https://invoices/
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	if err := runTokenCommand([]string{"mint", "-config", path, "-sub", "cli@clients", "-tenant", "acme", "-scope", "invoices:read"}, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(output.String(), "\n") || strings.Count(output.String(), "\n") != 1 {
+		t.Errorf("Expected the token alone on a line. Got %q\n", output.String())
+	}
+
+	auth, _ := NewAuthenticator(AuthConfig{Secret: "file_secret", Issuer: "https://file/", Audience: "https://invoices/", TenantClaim: DefaultTenantClaim})
+	request, _ := http.NewRequest("GET", "/invoices", nil)
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(output.String()))
+
+	principal, err := auth.Authenticate(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Subject != "cli@clients" || principal.Tenant != "acme" || !principal.HasScope("invoices:read") {
+		t.Errorf("Unexpected principal %+v\n", principal)
+	}
+
+	if err := runTokenCommand([]string{"revoke"}, &output); err == nil {
+		t.Errorf("An unknown subcommand was accepted\n")
+	}
+	if err := runTokenCommand([]string{"mint", "-config", path, "-sub", ""}, &output); err == nil {
+		t.Errorf("An empty subject was accepted\n")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/jvaesteves-xx/REST-in-Go")
+
+// setupTracing installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans; call it on
+// shutdown.
+func setupTracing(config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	closeFile := func() error { return nil }
+
+	switch config.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		options := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		var file *os.File
+		file, err = os.OpenFile(config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		closeFile = file.Close
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", config.Exporter)
+	}
+
+	if err != nil {
+		closeFile()
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := closeFile(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// TracingMiddleware continues the trace of an incoming traceparent header, if
+// any, with a server span named after the route template. It is installed
+// with Router.Use, so the route is already matched.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		route := routeTemplate(request)
+
+		ctx, span := tracer.Start(ctx, request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("http.route", route),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: response}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(recorder.status))
+		}
+	})
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// queryer is what *sql.DB and *sql.Tx have in common.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// startQuerySpan starts a client span for statement. Statements only ever
+// carry placeholders, so they are safe to export as they are.
+func startQuerySpan(ctx context.Context, statement string) (context.Context, trace.Span) {
+	verb := "SQL"
+	if fields := strings.Fields(statement); len(fields) > 0 {
+		verb = strings.ToUpper(fields[0])
+	}
+
+	return tracer.Start(ctx, verb,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", statement),
+		),
+	)
+}
+
+func execTraced(ctx context.Context, q queryer, statement string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, statement)
+	result, err := q.ExecContext(ctx, statement, args...)
+	endSpan(span, err)
+
+	return result, err
+}
+
+func queryTraced(ctx context.Context, q queryer, statement string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuerySpan(ctx, statement)
+	rows, err := q.QueryContext(ctx, statement, args...)
+	endSpan(span, err)
+
+	return rows, err
+}
+
+// queryRowTraced can't see the error of the query, which sql.Row only
+// reports on Scan.
+func queryRowTraced(ctx context.Context, q queryer, statement string, args ...interface{}) *sql.Row {
+	ctx, span := startQuerySpan(ctx, statement)
+	defer span.End()
+
+	return q.QueryRowContext(ctx, statement, args...)
+}
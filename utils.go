@@ -1,18 +1,109 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 )
 
-func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
+var (
+	ErrBodyTooLarge = errors.New("request body too large")
+	ErrTrailingData = errors.New("unexpected data after the JSON value")
+)
+
+// RespondWithError also reports the error code matching the status and the
+// request ID, which RequestLogMiddleware has set on the response before any
+// handler runs.
+func RespondWithError(w http.ResponseWriter, code int, message string) {
+	body := map[string]string{"error": message}
+	if errorCode, ok := errorCodes[code]; ok {
+		body["code"] = errorCode
+	}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(response)
+	Respond(w, code, body)
 }
 
-func RespondWithError(w http.ResponseWriter, code int, message string) {
-	RespondWithJSON(w, code, map[string]string{"error": message})
+// RequestBody caps request bodies at maxBytes and turns away those no codec
+// reads. A request without a Content-Type is taken as JSON, as clients have
+// always been able to send it that way. With strict set, decodeJSON rejects
+// fields the payload type doesn't have.
+func RequestBody(maxBytes int64, strict bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limited := BodyLimit(maxBytes, strict)(next)
+
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			if requestCodec(request) == nil {
+				RespondWithError(response, http.StatusUnsupportedMediaType, "Content-Type must be "+codecNames)
+				return
+			}
+
+			limited.ServeHTTP(response, request)
+		})
+	}
+}
+
+// BodyLimit is RequestBody without the Content-Type check, for the endpoints
+// taking other formats as well.
+func BodyLimit(maxBytes int64, strict bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			request.Body = http.MaxBytesReader(response, request.Body, maxBytes)
+			ctx := context.WithValue(request.Context(), strictJSONContextKey, strict)
+			next.ServeHTTP(response, request.WithContext(ctx))
+		})
+	}
+}
+
+// decodeJSON decodes a single JSON value from body into v. Anything but
+// whitespace after it is an error, and so are unknown fields in strict mode.
+func decodeJSON(ctx context.Context, body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	if strict, _ := ctx.Value(strictJSONContextKey).(bool); strict {
+		decoder.DisallowUnknownFields()
+	}
+
+	if err := decoder.Decode(v); err != nil {
+		return bodyError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return bodyError(ErrTrailingData)
+	}
+
+	return nil
+}
+
+// readBody reads the whole body of request, within the RequestBody limit.
+func readBody(request *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, bodyError(err)
+	}
+
+	return data, nil
+}
+
+// bodyError tells a body cut short by MaxBytesReader from a malformed one.
+func bodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ErrBodyTooLarge
+	}
+
+	return err
+}
+
+// respondWithBodyError answers a request whose body couldn't be read or
+// decoded.
+func respondWithBodyError(w http.ResponseWriter, err error) {
+	if err == ErrBodyTooLarge {
+		RespondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+
+	RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestBody(t *testing.T) {
+	decode := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		var invoice Invoice
+		if err := decodeBody(request, &invoice); err != nil {
+			respondWithBodyError(response, err)
+			return
+		}
+		Respond(response, http.StatusOK, invoice)
+	})
+
+	for _, test := range []struct {
+		strict      bool
+		contentType string
+		body        string
+		expected    int
+	}{
+		{false, "", `{"Document": "12345678901234"}`, http.StatusOK},
+		{false, "application/json; charset=utf-8", `{"Document": "12345678901234"}`, http.StatusOK},
+		{false, "text/plain", `{"Document": "12345678901234"}`, http.StatusUnsupportedMediaType},
+		{false, "", `{"Description": "` + strings.Repeat("a", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{false, "", `{"Document": "12345678901234"} {}`, http.StatusBadRequest},
+		{false, "", `{"Document": "12345678901234", "Lorem": "ipsum"}`, http.StatusOK},
+		{true, "", `{"Document": "12345678901234", "Lorem": "ipsum"}`, http.StatusBadRequest},
+		{false, "application/xml", `<Invoice><Document>12345678901234</Document></Invoice>`, http.StatusOK},
+		{false, "application/xml", `<Invoice><Amount>lorem</Amount></Invoice>`, http.StatusBadRequest},
+	} {
+		request, _ := http.NewRequest("POST", "/invoice", strings.NewReader(test.body))
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+		response := httptest.NewRecorder()
+		RequestBody(64, test.strict)(decode).ServeHTTP(response, request)
+
+		if response.Code != test.expected {
+			t.Errorf("%s (strict %v): expected %d. Got %d\n", test.body, test.strict, test.expected, response.Code)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The unversioned routes are an alias of /v1 kept for existing clients.
+// legacyDeprecation is when they were deprecated, and legacySunset when
+// they are due to go away.
+var (
+	legacyDeprecation = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset      = time.Date(2027, time.October, 19, 0, 0, 0, 0, time.UTC)
+)
+
+// APIVersion has the handlers under it speak version of the API. Version 0
+// is the unversioned one, with the JSON of the models as they are.
+func APIVersion(version int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			ctx := context.WithValue(request.Context(), apiVersionContextKey, version)
+			next.ServeHTTP(response, request.WithContext(ctx))
+		})
+	}
+}
+
+func apiVersion(ctx context.Context) int {
+	version, _ := ctx.Value(apiVersionContextKey).(int)
+	return version
+}
+
+// Deprecated marks the responses of the unversioned routes with when they
+// were deprecated (RFC 9745), when they will stop working (RFC 8594) and
+// where their /v1 successor is.
+func Deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := response.Header()
+		header.Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecation.Unix(), 10))
+		header.Set("Sunset", legacySunset.Format(http.TimeFormat))
+		header.Add("Link", `</v1`+request.URL.EscapedPath()+`>; rel="successor-version"`)
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+// InvoiceV1 is an invoice as /v1 shows it. Unlike Invoice, whose JSON
+// follows the database columns, its names and types are part of the API
+// contract and only change with the version.
+type InvoiceV1 struct {
+	XMLName        xml.Name   `json:"-" xml:"invoice"`
+	ReferenceMonth int        `json:"reference_month" xml:"reference_month"`
+	ReferenceYear  int        `json:"reference_year" xml:"reference_year"`
+	Document       string     `json:"document" xml:"document"`
+	Description    string     `json:"description" xml:"description"`
+	Amount         float64    `json:"amount" xml:"amount"`
+	IsActive       bool       `json:"is_active" xml:"is_active"`
+	CreatedAt      time.Time  `json:"created_at" xml:"created_at"`
+	DeactivatedAt  *time.Time `json:"deactivated_at" xml:"deactivated_at,omitempty"`
+}
+
+// InvoiceInputV1 is an invoice sent to /v1. CreatedAt is an RFC 3339
+// timestamp, or just its date; invoices only keep the date.
+type InvoiceInputV1 struct {
+	XMLName     xml.Name `json:"-" xml:"invoice"`
+	Document    string   `json:"document" xml:"document"`
+	Description string   `json:"description" xml:"description"`
+	Amount      float64  `json:"amount" xml:"amount"`
+	CreatedAt   string   `json:"created_at" xml:"created_at"`
+}
+
+type StatementLineV1 struct {
+	InvoiceV1
+	Balance float64 `json:"balance" xml:"balance"`
+}
+
+type StatementV1 struct {
+	XMLName     xml.Name          `json:"-" xml:"statement"`
+	Document    string            `json:"document" xml:"document"`
+	Invoices    []StatementLineV1 `json:"invoices" xml:"invoices>invoice"`
+	Years       []StatementYear   `json:"years" xml:"years>year"`
+	Total       float64           `json:"total" xml:"total"`
+	Deactivated int               `json:"deactivated" xml:"deactivated"`
+}
+
+type APIKeyV1 struct {
+	XMLName   xml.Name   `json:"-" xml:"api_key"`
+	ID        int64      `json:"id" xml:"id"`
+	Owner     string     `json:"owner" xml:"owner"`
+	Prefix    string     `json:"prefix" xml:"prefix"`
+	Scopes    []string   `json:"scopes" xml:"scopes>scope"`
+	CreatedAt time.Time  `json:"created_at" xml:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at" xml:"revoked_at,omitempty"`
+	// Key is only set when the key is created
+	Key string `json:"key,omitempty" xml:"key,omitempty"`
+}
+
+// invoiceDate reads the dates of an invoice, whether the driver handed
+// them over as a time or as a string.
+func invoiceDate(value interface{}) *time.Time {
+	date, err := time.Parse("2006-01-02", exportDate(value))
+	if err != nil {
+		return nil
+	}
+
+	return &date
+}
+
+// inputDate reduces an RFC 3339 timestamp to its date. Anything else is
+// left for validation.
+func inputDate(value string) string {
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp.Format("2006-01-02")
+	}
+
+	return value
+}
+
+func invoiceV1(invoice Invoice) InvoiceV1 {
+	v1 := InvoiceV1{
+		ReferenceMonth: invoice.ReferenceMonth,
+		ReferenceYear:  invoice.ReferenceYear,
+		Document:       invoice.Document,
+		Description:    invoice.Description,
+		Amount:         math.Round(float64(invoice.Amount)*100) / 100,
+		IsActive:       invoice.IsActive,
+		DeactivatedAt:  invoiceDate(invoice.DeactiveAt),
+	}
+	if created := invoiceDate(invoice.CreatedAt); created != nil {
+		v1.CreatedAt = *created
+	}
+
+	return v1
+}
+
+func (input InvoiceInputV1) Invoice() Invoice {
+	return Invoice{
+		Document:    input.Document,
+		Description: input.Description,
+		Amount:      float32(input.Amount),
+		CreatedAt:   inputDate(input.CreatedAt),
+	}
+}
+
+func apiKeyV1(key APIKey) APIKeyV1 {
+	return APIKeyV1{ID: key.ID, Owner: key.Owner, Prefix: key.Prefix, Scopes: key.Scopes, CreatedAt: key.CreatedAt, RevokedAt: key.RevokedAt}
+}
+
+// presentStatement is statement as the API version of ctx shows it.
+func presentStatement(ctx context.Context, statement Statement) interface{} {
+	if apiVersion(ctx) == 0 {
+		return statement
+	}
+
+	v1 := StatementV1{
+		Document:    statement.Document,
+		Invoices:    make([]StatementLineV1, len(statement.Invoices)),
+		Years:       statement.Years,
+		Total:       statement.Total,
+		Deactivated: statement.Deactivated,
+	}
+	for i, line := range statement.Invoices {
+		v1.Invoices[i] = StatementLineV1{invoiceV1(line.Invoice), line.Balance}
+	}
+
+	return v1
+}
+
+// presentInvoice is invoice as the API version of ctx shows it.
+func presentInvoice(ctx context.Context, invoice Invoice) interface{} {
+	if apiVersion(ctx) == 0 {
+		return invoice
+	}
+
+	return invoiceV1(invoice)
+}
+
+func presentInvoices(ctx context.Context, invoices []Invoice) interface{} {
+	if apiVersion(ctx) == 0 {
+		return invoices
+	}
+
+	v1 := make([]InvoiceV1, len(invoices))
+	for i, invoice := range invoices {
+		v1[i] = invoiceV1(invoice)
+	}
+
+	return v1
+}
+
+// decodeInvoice decodes an invoice from r in codec, in the form the API
+// version of ctx takes it.
+func decodeInvoice(ctx context.Context, codec Codec, r io.Reader) (Invoice, error) {
+	if apiVersion(ctx) == 0 {
+		var invoice Invoice
+		err := codec.Decode(ctx, r, &invoice)
+		return invoice, err
+	}
+
+	var input InvoiceInputV1
+	err := codec.Decode(ctx, r, &input)
+	return input.Invoice(), err
+}
+
+// updateFields turns the fields of an update sent to /v1 into those of
+// Invoice, which validateUpdate and UpdateInvoice work with.
+func updateFields(ctx context.Context, fields map[string]interface{}) map[string]interface{} {
+	if apiVersion(ctx) == 0 || fields == nil {
+		return fields
+	}
+
+	names := map[string]string{"document": "Document", "description": "Description", "amount": "Amount", "created_at": "CreatedAt"}
+	updated := make(map[string]interface{}, len(fields))
+
+	for key, value := range fields {
+		name, ok := names[strings.ToLower(key)]
+		if !ok {
+			continue
+		}
+		if date, isText := value.(string); isText && name == "CreatedAt" {
+			value = inputDate(date)
+		}
+		updated[name] = value
+	}
+
+	return updated
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvoiceV1(t *testing.T) {
+	invoice := Invoice{Tenant: "acme", ReferenceMonth: 7, ReferenceYear: 2019, Document: "12345678901234", Amount: 10.3, CreatedAt: "2019-07-01T00:00:00Z", DeactiveAt: time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC)}
+
+	data, _ := json.Marshal(invoiceV1(invoice))
+	expected := `{"reference_month":7,"reference_year":2019,"document":"12345678901234","description":"","amount":10.3,"is_active":false,"created_at":"2019-07-01T00:00:00Z","deactivated_at":"2019-08-02T00:00:00Z"}`
+	if string(data) != expected {
+		t.Errorf("Expected %s. Got %s\n", expected, data)
+	}
+
+	invoice.IsActive, invoice.DeactiveAt = true, nil
+	data, _ = json.Marshal(invoiceV1(invoice))
+	if !strings.Contains(string(data), `"deactivated_at":null`) {
+		t.Errorf("Expected a null deactivated_at. Got %s\n", data)
+	}
+}
+
+func TestInvoiceInputV1(t *testing.T) {
+	for createdAt, expected := range map[string]string{
+		"2019-07-01T23:30:00-03:00": "2019-07-01",
+		"2019-07-01":                "2019-07-01",
+		"01/07/2019":                "01/07/2019",
+	} {
+		if invoice := (InvoiceInputV1{CreatedAt: createdAt}).Invoice(); invoice.CreatedAt != expected {
+			t.Errorf("Expected %s as %s. Got %s\n", createdAt, expected, invoice.CreatedAt)
+		}
+	}
+}
+
+func TestUpdateFieldsV1(t *testing.T) {
+	ctx := context.WithValue(context.Background(), apiVersionContextKey, 1)
+	fields := updateFields(ctx, map[string]interface{}{"amount": 12.5, "created_at": "2019-07-01T10:00:00Z", "is_active": false})
+
+	if len(fields) != 2 || fields["Amount"] != 12.5 || fields["CreatedAt"] != "2019-07-01" {
+		t.Errorf("Unexpected fields %v\n", fields)
+	}
+
+	legacy := map[string]interface{}{"Amount": 12.5}
+	if fields := updateFields(context.Background(), legacy); len(fields) != 1 || fields["Amount"] != 12.5 {
+		t.Errorf("Expected legacy fields untouched. Got %v\n", fields)
+	}
+}
+
+func TestDecodeBatchV1(t *testing.T) {
+	body := `{"atomic": true, "operations": [
+		{"op": "create", "invoice": {"document": "12345678901234", "amount": 1, "created_at": "2019-07-01T00:00:00Z"}},
+		{"op": "update", "year": 2019, "month": 7, "document": "12345678901234", "fields": {"amount": 2}}
+	]}`
+
+	request, _ := http.NewRequest("POST", "/v1/invoices/batch", strings.NewReader(body))
+	request = request.WithContext(context.WithValue(request.Context(), apiVersionContextKey, 1))
+
+	var batch BatchRequest
+	if err := decodeBatch(request, &batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if !batch.Atomic || len(batch.Operations) != 2 {
+		t.Fatalf("Unexpected batch %+v\n", batch)
+	}
+	if invoice := batch.Operations[0].Invoice; invoice == nil || invoice.Document != "12345678901234" || invoice.CreatedAt != "2019-07-01" {
+		t.Errorf("Unexpected invoice %+v\n", invoice)
+	}
+	if err := batch.Operations[1].Validate(); err != nil || batch.Operations[1].Fields["Amount"] != 2.0 {
+		t.Errorf("Unexpected update %+v: %v\n", batch.Operations[1], err)
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	handler := Deprecated(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+
+	request, _ := http.NewRequest("GET", "/invoices/2019?page=2", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if response.Header().Get("Deprecation") != "@1792368000" || response.Header().Get("Sunset") != "Tue, 19 Oct 2027 00:00:00 GMT" {
+		t.Errorf("Unexpected deprecation headers %v\n", response.Header())
+	}
+	if link := response.Header().Get("Link"); link != `</v1/invoices/2019>; rel="successor-version"` {
+		t.Errorf("Unexpected Link %s\n", link)
+	}
+}